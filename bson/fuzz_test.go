@@ -0,0 +1,96 @@
+package bson
+
+import (
+	"testing"
+)
+
+type fuzzInner struct {
+	X int
+	S string
+}
+
+type fuzzTarget struct {
+	Key    []byte
+	Name   string
+	N      int
+	U      uint8
+	F      float64
+	B      bool
+	Any    any
+	List   []string
+	Inner  fuzzInner
+	Inners []fuzzInner
+	Nested [][]int
+	Map    map[string]int
+}
+
+// fuzzSeeds returns documents of every type the decoder handles.
+func fuzzSeeds(t testing.TB) [][]byte {
+	values := []any{
+		M{},
+		M{"a": 1.5, "b": "x", "c": int32(1), "d": int64(2), "e": true, "f": []byte{1, 2}, "g": nil},
+		M{"m": M{"n": A{int32(1), "two", M{"X": int32(3)}, nil}}},
+		fuzzTarget{
+			Key:    []byte("key"),
+			Name:   "name",
+			N:      -7,
+			U:      200,
+			F:      0.25,
+			B:      true,
+			Any:    M{"Z": "z"},
+			List:   []string{"a", "b"},
+			Inner:  fuzzInner{X: 1, S: "s"},
+			Inners: []fuzzInner{{X: 2}, {S: "t"}},
+			Nested: [][]int{{1}, {2, 3}},
+		},
+	}
+	var seeds [][]byte
+	for _, v := range values {
+		data, err := Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeds = append(seeds, data)
+	}
+	return seeds
+}
+
+func FuzzReadDocument(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewReader(data)
+		doc, err := r.ReadDocument()
+		if err != nil {
+			return
+		}
+		for _, raw := range doc.Pairs {
+			if raw.Type == Array {
+				NewReader(raw.Data).ReadArray()
+			}
+		}
+	})
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m M
+		Unmarshal(data, &m)
+		var d D
+		Unmarshal(data, &d)
+		var a A
+		Unmarshal(data, &a)
+		var target fuzzTarget
+		Unmarshal(data, &target)
+		var s string
+		Unmarshal(data, &s)
+		var b []byte
+		Unmarshal(data, &b)
+		var n int64
+		Unmarshal(data, &n)
+	})
+}
@@ -117,7 +117,8 @@ func (a A) MarshalBSONValue() (Type, []byte, error) {
 func (bd BSONBinData) MarshalBSONValue() (Type, []byte, error) {
 	buf := new(bytes.Buffer)
 	err := binary.Write(buf, binary.LittleEndian, int32(len(bd)))
-	err = binary.Write(buf, binary.LittleEndian, bd)
+	err = binary.Write(buf, binary.LittleEndian, BinaryGeneric)
+	err = binary.Write(buf, binary.LittleEndian, []byte(bd))
 	if err != nil {
 		return 0, nil, err
 	}
@@ -282,7 +283,7 @@ func MarshalValue(v any) (Type, []byte, error) {
 		}
 	case ValueMarshaler:
 		return o.MarshalBSONValue()
-	case uint8, uint16, uint32, int8, int16, int32, int64, int, uint:
+	case uint8, uint16, uint32, uint64, int8, int16, int32, int64, int, uint:
 		return marshalInt(o)
 	case float64:
 		return BSONDouble(o).MarshalBSONValue()
@@ -309,15 +310,17 @@ func MarshalValue(v any) (Type, []byte, error) {
 			}
 			return MarshalValue(a)
 		case reflect.Map:
-			val := reflect.ValueOf(v)
-			m := M{}
-			for _, key := range val.MapKeys() {
-				m[key.Interface().(string)] = val.MapIndex(key).Interface()
+			m, err := mapToM(v)
+			if err != nil {
+				return 0, nil, err
 			}
 			return MarshalValue(m)
 		case reflect.Ptr:
-			val := reflect.Indirect(reflect.ValueOf(v))
-			return MarshalValue(val.Interface())
+			val := reflect.ValueOf(v)
+			if val.IsNil() {
+				return Null, nil, nil
+			}
+			return MarshalValue(val.Elem().Interface())
 		default:
 			return 0, nil, fmt.Errorf("cannot marshal value of type %T", v)
 		}
@@ -334,6 +337,8 @@ func Marshal(v any) ([]byte, error) {
 			return nil, err
 		}
 		return data, nil
+	case nil:
+		return nil, fmt.Errorf("cannot marshal nil")
 	default:
 		t := reflect.TypeOf(v)
 		switch t.Kind() {
@@ -351,21 +356,36 @@ func Marshal(v any) ([]byte, error) {
 			}
 			return Marshal(a)
 		case reflect.Map:
-			val := reflect.ValueOf(v)
-			m := M{}
-			for _, key := range val.MapKeys() {
-				m[key.Interface().(string)] = val.MapIndex(key).Interface()
+			m, err := mapToM(v)
+			if err != nil {
+				return nil, err
 			}
 			return Marshal(m)
 		case reflect.Ptr:
-			val := reflect.Indirect(reflect.ValueOf(v))
-			return Marshal(val.Interface())
+			val := reflect.ValueOf(v)
+			if val.IsNil() {
+				return nil, fmt.Errorf("cannot marshal nil %T", v)
+			}
+			return Marshal(val.Elem().Interface())
 		default:
 			return nil, fmt.Errorf("cannot marshal object of type %T", v)
 		}
 	}
 }
 
+// mapToM copies a map with string keys into an M.
+func mapToM(v any) (M, error) {
+	val := reflect.ValueOf(v)
+	if val.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("cannot marshal %T, map keys must be strings", v)
+	}
+	m := M{}
+	for _, key := range val.MapKeys() {
+		m[key.String()] = val.MapIndex(key).Interface()
+	}
+	return m, nil
+}
+
 func marshalStruct(s any) (Type, []byte, error) {
 	rValue := reflect.ValueOf(s)
 	rType := rValue.Type()
@@ -374,12 +394,15 @@ func marshalStruct(s any) (Type, []byte, error) {
 	}
 	innerBuf := new(bytes.Buffer)
 	for i := 0; i < rType.NumField(); i++ {
+		if !rType.Field(i).IsExported() {
+			continue
+		}
 		fieldName := rType.Field(i).Name
 		fieldType := rValue.Field(i).Type()
 		fieldValue := rValue.Field(i).Interface()
 		fieldValType := reflect.TypeOf(fieldValue)
-		if fieldType.Kind() == reflect.Interface {
-			TypeRegistry[rType.Name()+"."+fieldName] = fieldValType
+		if fieldType.Kind() == reflect.Interface && fieldValType != nil {
+			registerType(rType.Name()+"."+fieldName, fieldValType)
 		}
 		pairBytes, err := Pair{Key: fieldName, Val: fieldValue}.MarshalBSON()
 		if err != nil {
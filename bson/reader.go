@@ -3,6 +3,7 @@ package bson
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"strconv"
 )
@@ -16,6 +17,16 @@ func NewReader(data []byte) *Reader {
 	return &Reader{0, data}
 }
 
+// ErrTruncated is returned when a document ends before the data it declares.
+var ErrTruncated = errors.New("bson: truncated document")
+
+func (r *Reader) need(n int) error {
+	if n < 0 || r.pos+n > len(r.data) {
+		return ErrTruncated
+	}
+	return nil
+}
+
 func (r *Reader) ReadDocument() (*RawD, error) {
 	raw := &RawD{Pairs: make(map[string]*Raw)}
 	size, err := r.ReadSize()
@@ -64,6 +75,9 @@ func (r *Reader) ReadArray() (*RawArray, error) {
 }
 
 func (r *Reader) ReadSize() (int32, error) {
+	if err := r.need(4); err != nil {
+		return 0, err
+	}
 	var size int32
 	err := binary.Read(bytes.NewReader(r.data[r.pos:r.pos+4]), binary.LittleEndian, &size)
 	if err != nil {
@@ -74,10 +88,19 @@ func (r *Reader) ReadSize() (int32, error) {
 }
 
 func (r *Reader) ReadField() (BSONField, error) {
+	if err := r.need(1); err != nil {
+		return BSONField{}, err
+	}
 	t := Type(r.data[r.pos])
 	r.pos++
 	start := r.pos
-	for r.data[r.pos] != byte(0) {
+	for {
+		if err := r.need(1); err != nil {
+			return BSONField{}, err
+		}
+		if r.data[r.pos] == byte(0) {
+			break
+		}
 		r.pos++
 	}
 	field := string(r.data[start:r.pos])
@@ -95,6 +118,9 @@ func (r *Reader) ReadValue(t Type) (*Raw, error) {
 		}
 		return raw, nil
 	case Double:
+		if err := r.need(8); err != nil {
+			return nil, err
+		}
 		start := r.pos
 		r.pos += 8
 		return &Raw{Double, r.data[start:r.pos]}, nil
@@ -105,10 +131,16 @@ func (r *Reader) ReadValue(t Type) (*Raw, error) {
 		}
 		return raw, nil
 	case Int:
+		if err := r.need(4); err != nil {
+			return nil, err
+		}
 		start := r.pos
 		r.pos += 4
 		return &Raw{Int, r.data[start:r.pos]}, nil
 	case Long:
+		if err := r.need(8); err != nil {
+			return nil, err
+		}
 		start := r.pos
 		r.pos += 8
 		return &Raw{Long, r.data[start:r.pos]}, nil
@@ -119,13 +151,36 @@ func (r *Reader) ReadValue(t Type) (*Raw, error) {
 		}
 		return raw, nil
 	case Bool:
+		if err := r.need(1); err != nil {
+			return nil, err
+		}
 		start := r.pos
 		r.pos += 1
 		return &Raw{Bool, r.data[start:r.pos]}, nil
+	case BinData:
+		raw, err := r.ReadBinary()
+		if err != nil {
+			return nil, err
+		}
+		return raw, nil
 	case Null:
 		return &Raw{Null, nil}, nil
 	}
-	return nil, nil
+	return nil, fmt.Errorf("unsupported type 0x%02x", byte(t))
+}
+
+func (r *Reader) ReadBinary() (*Raw, error) {
+	length, err := r.ReadSize()
+	if err != nil {
+		return nil, err
+	}
+	start := r.pos - 4
+	end := r.pos + 1 + int(length)
+	if length < 0 || end > len(r.data) || end < r.pos {
+		return nil, fmt.Errorf("binary length mismatch")
+	}
+	r.pos = end
+	return &Raw{BinData, r.data[start:end]}, nil
 }
 
 func (r *Reader) ReadString() (*Raw, error) {
@@ -133,6 +188,9 @@ func (r *Reader) ReadString() (*Raw, error) {
 	if err != nil {
 		return nil, err
 	}
+	if length < 1 || r.need(int(length)) != nil {
+		return nil, ErrTruncated
+	}
 	start := int32(r.pos)
 	if r.data[start+length-1] != byte(0) {
 		return nil, fmt.Errorf("string length mismatch")
@@ -162,6 +220,9 @@ func (r *Reader) ReadSized() (int32, error) {
 	if err != nil {
 		return 0, err
 	}
+	if length < 5 || r.need(int(length)-4) != nil {
+		return 0, ErrTruncated
+	}
 	start := int32(r.pos)
 	docBytes := r.data[start : start+length-4]
 	if docBytes[len(docBytes)-1] != byte(0) {
@@ -1,6 +1,9 @@
 package bson
 
-import "reflect"
+import (
+	"reflect"
+	"sync"
+)
 
 type Type int8
 
@@ -16,6 +19,9 @@ const (
 	Long    Type = 0x12
 )
 
+// BinaryGeneric is the subtype written for binary data.
+const BinaryGeneric byte = 0x00
+
 type Pair struct {
 	Key string
 	Val any
@@ -54,3 +60,18 @@ type Field struct {
 }
 
 var TypeRegistry = map[string]reflect.Type{}
+
+var typeRegistryMu sync.RWMutex
+
+func registerType(key string, t reflect.Type) {
+	typeRegistryMu.Lock()
+	defer typeRegistryMu.Unlock()
+	TypeRegistry[key] = t
+}
+
+func registeredType(key string) (reflect.Type, bool) {
+	typeRegistryMu.RLock()
+	defer typeRegistryMu.RUnlock()
+	t, ok := TypeRegistry[key]
+	return t, ok
+}
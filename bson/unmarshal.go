@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"go/token"
 	"reflect"
 	"slices"
 )
@@ -17,7 +18,7 @@ type ValueUnmarshaler interface {
 }
 
 func (rv Raw) Unmarshal(v any) error {
-	if v == nil || reflect.TypeOf(v).Kind() != reflect.Ptr {
+	if v == nil || reflect.TypeOf(v).Kind() != reflect.Ptr || reflect.ValueOf(v).IsNil() {
 		return fmt.Errorf("value must be non-nil and a pointer")
 	}
 	var err error
@@ -33,6 +34,9 @@ func (rv Raw) Unmarshal(v any) error {
 		if !ok {
 			return fmt.Errorf("cannot unmarshal String into %T", t)
 		}
+		if len(rv.Data) < 5 {
+			return ErrTruncated
+		}
 		*t = string(rv.Data)[4 : len(rv.Data)-1]
 	case Int:
 		t, ok := v.(*int32)
@@ -52,6 +56,15 @@ func (rv Raw) Unmarshal(v any) error {
 			return fmt.Errorf("cannot unmarshal Bool into %T", t)
 		}
 		err = binary.Read(bytes.NewReader(rv.Data), binary.LittleEndian, t)
+	case BinData:
+		t, ok := v.(*[]byte)
+		if !ok {
+			return fmt.Errorf("cannot unmarshal BinData into %T", t)
+		}
+		if len(rv.Data) < 5 {
+			return ErrTruncated
+		}
+		*t = append([]byte(nil), rv.Data[5:]...)
 	case Array:
 		t, ok := v.(*A)
 		if !ok {
@@ -70,6 +83,58 @@ func (rv Raw) Unmarshal(v any) error {
 	return err
 }
 
+// value decodes rv into the Go value it holds, decoding documents with
+// object.
+func (rv Raw) value(object func([]byte) (any, error)) (any, error) {
+	switch rv.Type {
+	case Double:
+		var v float64
+		err := rv.Unmarshal(&v)
+		return v, err
+	case String:
+		var v string
+		err := rv.Unmarshal(&v)
+		return v, err
+	case Int:
+		var v int32
+		err := rv.Unmarshal(&v)
+		return v, err
+	case Long:
+		var v int64
+		err := rv.Unmarshal(&v)
+		return v, err
+	case Bool:
+		var v bool
+		err := rv.Unmarshal(&v)
+		return v, err
+	case BinData:
+		var v []byte
+		err := rv.Unmarshal(&v)
+		return v, err
+	case Object:
+		return object(rv.Data)
+	case Array:
+		var v A
+		err := v.UnmarshalBSON(rv.Data)
+		return v, err
+	case Null:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported type 0x%02x", byte(rv.Type))
+}
+
+func unmarshalD(b []byte) (any, error) {
+	var d D
+	err := d.UnmarshalBSON(b)
+	return d, err
+}
+
+func unmarshalM(b []byte) (any, error) {
+	m := M{}
+	err := m.UnmarshalBSON(b)
+	return m, err
+}
+
 func (d *D) UnmarshalBSON(b []byte) error {
 	r := NewReader(b)
 	raw, err := r.ReadDocument()
@@ -78,38 +143,9 @@ func (d *D) UnmarshalBSON(b []byte) error {
 	}
 
 	for field, val := range raw.Pairs {
-		var value any
-		switch val.Type {
-		case Double:
-			v := new(float64)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case String:
-			v := new(string)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case Int:
-			v := new(int32)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case Long:
-			v := new(int64)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case Bool:
-			v := new(bool)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case Object:
-			v := new(D)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case Null:
-			value = nil
-		case Array:
-			v := new(A)
-			err = v.UnmarshalBSON(val.Data)
-			value = *v
+		value, err := val.value(unmarshalD)
+		if err != nil {
+			return err
 		}
 		*d = append(*d, Pair{Key: field, Val: value})
 	}
@@ -123,39 +159,13 @@ func (m *M) UnmarshalBSON(b []byte) error {
 		return err
 	}
 
+	if *m == nil {
+		*m = M{}
+	}
 	for field, val := range raw.Pairs {
-		var value any
-		switch val.Type {
-		case Double:
-			v := new(float64)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case String:
-			v := new(string)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case Int:
-			v := new(int32)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case Long:
-			v := new(int64)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case Bool:
-			v := new(bool)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case Object:
-			v := M{}
-			err = UnmarshalValue(val.Type, val.Data, &v)
-			value = v
-		case Null:
-			value = nil
-		case Array:
-			v := new(A)
-			err = v.UnmarshalBSON(val.Data)
-			value = *v
+		value, err := val.value(unmarshalM)
+		if err != nil {
+			return err
 		}
 		(*m)[field] = value
 	}
@@ -170,38 +180,7 @@ func (a *A) UnmarshalBSON(b []byte) error {
 	}
 
 	for _, val := range *raw {
-		var value any
-		switch val.Type {
-		case Double:
-			v := new(float64)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case String:
-			v := new(string)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case Int:
-			v := new(int32)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case Long:
-			v := new(int64)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case Bool:
-			v := new(bool)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		case Object:
-			v := M{}
-			err = UnmarshalValue(val.Type, val.Data, &v)
-			value = v
-		case Null:
-		case Array:
-			v := new(A)
-			err = UnmarshalValue(val.Type, val.Data, v)
-			value = *v
-		}
+		value, err := val.value(unmarshalM)
 		if err != nil {
 			return err
 		}
@@ -216,13 +195,11 @@ func UnmarshalValue(t Type, v []byte, o any) error {
 
 func Unmarshal(data []byte, obj any) error {
 	rValue := reflect.ValueOf(obj)
-	rType := rValue.Type()
-	if rType.Kind() != reflect.Ptr {
-		return fmt.Errorf("object to unmarshal into must be a pointer")
+	if obj == nil || rValue.Kind() != reflect.Ptr || rValue.IsNil() {
+		return fmt.Errorf("object to unmarshal into must be a non-nil pointer")
 	}
+	rType := rValue.Type()
 	switch t := obj.(type) {
-	case nil:
-		return UnmarshalValue(Null, data, obj)
 	case Unmarshaler:
 		return t.UnmarshalBSON(data)
 	case *float64:
@@ -235,6 +212,8 @@ func Unmarshal(data []byte, obj any) error {
 		return UnmarshalValue(Long, data, obj)
 	case *bool:
 		return UnmarshalValue(Bool, data, obj)
+	case *[]byte:
+		return UnmarshalValue(BinData, data, obj)
 	default:
 		if rType.Elem().Kind() == reflect.Struct {
 			m := M{}
@@ -252,6 +231,8 @@ func Unmarshal(data []byte, obj any) error {
 	}
 }
 
+var bytesType = reflect.TypeOf([]byte(nil))
+
 func unmarshalToStruct(m M, obj any) error {
 	rValue := reflect.ValueOf(obj)
 	rType := rValue.Type()
@@ -266,6 +247,9 @@ func unmarshalToStruct(m M, obj any) error {
 	for k, v := range m {
 		vType := reflect.TypeOf(v)
 		field := rValue.Elem().FieldByName(k)
+		if !field.IsValid() || !field.CanSet() {
+			return fmt.Errorf("%s has no field %s", rType.Elem(), k)
+		}
 		fieldType := field.Type()
 		var valueToSetType reflect.Type
 		if v == nil {
@@ -273,31 +257,47 @@ func unmarshalToStruct(m M, obj any) error {
 			continue
 		}
 		if fieldType.Kind() == reflect.Interface {
+			// Only documents and arrays need the registered type to be
+			// rebuilt; scalars decode to their own type, which the last
+			// value marshaled into this field may not share.
 			regKey := rType.Elem().Name() + "." + k
-			typ, exists := TypeRegistry[regKey]
-			if !exists {
-				valueToSetType = reflect.TypeOf(v)
-			} else {
+			typ, exists := registeredType(regKey)
+			if exists && typ != nil && (vType.Kind() == reflect.Map && (typ.Kind() == reflect.Struct || typ.Kind() == reflect.Map) ||
+				vType.Kind() == reflect.Slice && vType != bytesType && typ.Kind() == reflect.Slice) {
 				valueToSetType = typ
-				//delete(TypeRegistry, k)
+			} else {
+				valueToSetType = vType
 			}
-
 		} else {
 			valueToSetType = fieldType
 		}
+		if b, ok := v.([]byte); ok {
+			if !canConvertBytes(b, valueToSetType) {
+				return fmt.Errorf("cannot unmarshal BinData into field %s of type %s", k, fieldType)
+			}
+			field.Set(reflect.ValueOf(b).Convert(valueToSetType))
+			continue
+		}
 		switch vType.Kind() {
 		case reflect.Map:
 			newStruct, err := StructFromBSONMap(v.(M), valueToSetType)
 			if err != nil {
 				return err
 			}
-			field.Set(reflect.ValueOf(newStruct).Elem())
+			if err := setField(field, k, reflect.ValueOf(newStruct).Elem()); err != nil {
+				return err
+			}
 		case reflect.Array, reflect.Slice:
+			if valueToSetType.Kind() != reflect.Slice {
+				return fmt.Errorf("cannot unmarshal Array into field %s of type %s", k, fieldType)
+			}
 			newArray, err := sliceFromBSONArray(v.(A), valueToSetType)
 			if err != nil {
 				return err
 			}
-			field.Set(*newArray)
+			if err := setField(field, k, *newArray); err != nil {
+				return err
+			}
 		case reflect.Int32, reflect.Int64:
 			if field.Type().Kind() == reflect.Interface {
 				field.Set(reflect.ValueOf(v))
@@ -310,20 +310,26 @@ func unmarshalToStruct(m M, obj any) error {
 		case reflect.Float64:
 			if fieldType.Kind() == reflect.Interface {
 				field.Set(reflect.ValueOf(v))
-			} else {
+			} else if fieldType.Kind() == reflect.Float64 || fieldType.Kind() == reflect.Float32 {
 				field.SetFloat(v.(float64))
+			} else {
+				return fmt.Errorf("cannot unmarshal Double into field %s of type %s", k, fieldType)
 			}
 		case reflect.String:
 			if fieldType.Kind() == reflect.Interface {
 				field.Set(reflect.ValueOf(v))
-			} else {
+			} else if fieldType.Kind() == reflect.String {
 				field.SetString(v.(string))
+			} else {
+				return fmt.Errorf("cannot unmarshal String into field %s of type %s", k, fieldType)
 			}
 		case reflect.Bool:
 			if fieldType.Kind() == reflect.Interface {
 				field.Set(reflect.ValueOf(v))
-			} else {
+			} else if fieldType.Kind() == reflect.Bool {
 				field.SetBool(v.(bool))
+			} else {
+				return fmt.Errorf("cannot unmarshal Bool into field %s of type %s", k, fieldType)
 			}
 		default:
 			return fmt.Errorf("cannot unmarshal into %T", m[k])
@@ -332,10 +338,37 @@ func unmarshalToStruct(m M, obj any) error {
 	return nil
 }
 
+// setField sets the field named name to value, failing if value is of a
+// type the field cannot hold.
+func setField(field reflect.Value, name string, value reflect.Value) error {
+	if !value.Type().AssignableTo(field.Type()) {
+		return fmt.Errorf("cannot unmarshal %s into field %s of type %s", value.Type(), name, field.Type())
+	}
+	field.Set(value)
+	return nil
+}
+
+// canConvertBytes reports whether b can be converted to t, which must be
+// a byte slice, a string or a byte array of the same length.
+func canConvertBytes(b []byte, t reflect.Type) bool {
+	if !bytesType.ConvertibleTo(t) {
+		return false
+	}
+	return t.Kind() != reflect.Array || t.Len() == len(b)
+}
+
+// structTypeFromBSONMap returns a struct type with a field for each key of
+// m, which must all be exported Go identifiers.
 func structTypeFromBSONMap(m M) (reflect.Type, error) {
 	var structFields []reflect.StructField
 	var err error
 	for key, val := range m {
+		if !token.IsIdentifier(key) || !token.IsExported(key) {
+			return nil, fmt.Errorf("cannot unmarshal field %q into a struct", key)
+		}
+		if val == nil {
+			return nil, fmt.Errorf("cannot infer the type of field %s", key)
+		}
 		typ := reflect.TypeOf(val)
 		if typ.Kind() == reflect.Map {
 			typ, err = structTypeFromBSONMap(val.(M))
@@ -358,21 +391,10 @@ func StructFromBSONMap(m M, valueType reflect.Type) (any, error) {
 	}
 	var newStruct any
 	if valueType.Kind() == reflect.Map {
-		var structFields []reflect.StructField
-		for key, val := range m {
-			valType := reflect.TypeOf(val)
-			if reflect.TypeOf(val).Kind() == reflect.Map {
-				valType, err = structTypeFromBSONMap(val.(M))
-				if err != nil {
-					return nil, err
-				}
-			}
-			structFields = append(structFields, reflect.StructField{
-				Name: key,
-				Type: valType,
-			})
+		typ, err := structTypeFromBSONMap(m)
+		if err != nil {
+			return nil, err
 		}
-		typ := reflect.StructOf(structFields)
 		newStruct = reflect.New(typ).Interface()
 	} else {
 		newStruct = reflect.New(valueType).Interface()
@@ -384,23 +406,61 @@ func StructFromBSONMap(m M, valueType reflect.Type) (any, error) {
 	return newStruct, nil
 }
 
+// sliceFromBSONArray converts fromArray to a slice of newArrayType. Documents
+// are converted to the element type, or kept as M when it is an interface,
+// and numbers to the element type's kind of number.
 func sliceFromBSONArray(fromArray A, newArrayType reflect.Type) (*reflect.Value, error) {
 	newArray := reflect.MakeSlice(newArrayType, len(fromArray), len(fromArray))
-	for i := 0; i < newArray.Len(); i++ {
-		elemType := reflect.TypeOf(newArray.Index(i).Interface())
-		if reflect.TypeOf(fromArray[i]).Kind() == reflect.Map {
-			newStruct, err := StructFromBSONMap(fromArray[i].(M), elemType)
+	elemType := newArrayType.Elem()
+	for i, from := range fromArray {
+		var value reflect.Value
+		switch v := from.(type) {
+		case nil:
+			continue
+		case M:
+			if elemType.Kind() == reflect.Interface {
+				value = reflect.ValueOf(v)
+				break
+			}
+			newStruct, err := StructFromBSONMap(v, elemType)
 			if err != nil {
 				return nil, err
 			}
-			newArray.Index(i).Set(reflect.ValueOf(newStruct).Elem())
-		} else {
-			newArray.Index(i).Set(reflect.ValueOf(fromArray[i]))
+			value = reflect.ValueOf(newStruct).Elem()
+		case A:
+			if elemType.Kind() != reflect.Slice {
+				value = reflect.ValueOf(v)
+				break
+			}
+			nested, err := sliceFromBSONArray(v, elemType)
+			if err != nil {
+				return nil, err
+			}
+			value = *nested
+		default:
+			value = reflect.ValueOf(v)
 		}
+		if !value.Type().AssignableTo(elemType) {
+			if !isNumber(value.Kind()) || !isNumber(elemType.Kind()) {
+				return nil, fmt.Errorf("cannot unmarshal %s into an element of %s", value.Type(), newArrayType)
+			}
+			value = value.Convert(elemType)
+		}
+		newArray.Index(i).Set(value)
 	}
 	return &newArray, nil
 }
 
+func isNumber(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
 func setStructIntegerField(field reflect.Value, v any) error {
 	rValue, vType, fieldType := reflect.ValueOf(v), reflect.TypeOf(v), field.Type()
 	intKinds := []reflect.Kind{
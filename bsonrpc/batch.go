@@ -0,0 +1,203 @@
+package bsonrpc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"go-dht/bson"
+	"log"
+	"sync"
+)
+
+// BatchRequest is the envelope of several Calls sent to a server as one
+// request. The server runs them in order and answers with a BatchReply.
+type BatchRequest struct {
+	Seq   uint64
+	Calls []Call
+}
+
+// BatchReply carries the Reply to every Call of a BatchRequest, in the same
+// order as the calls.
+type BatchReply struct {
+	Seq     uint64
+	Replies []Reply
+}
+
+// BatchCall is one call of a Batch. Once the batch has been sent, Error is
+// set if the call failed and Reply holds its result otherwise.
+type BatchCall struct {
+	Method string
+	Args   any
+	Reply  any
+	Error  error
+}
+
+// Batch collects calls to the same server so that they are sent, and
+// answered, in one message instead of one per call.
+type Batch struct {
+	Calls []*BatchCall
+}
+
+// Add appends a call to the batch and returns it.
+func (b *Batch) Add(methodName string, args any, reply any) *BatchCall {
+	call := &BatchCall{Method: methodName, Args: args, Reply: reply}
+	b.Calls = append(b.Calls, call)
+	return call
+}
+
+// CallBatch sends every call of b in one request and waits for their
+// replies. The returned error is set when the batch as a whole failed, for
+// example because the server was busy or ctx ended, in which case every call
+// carries it too; otherwise each call carries its own outcome.
+//
+// Client interceptors are run for every call in the batch, as the server runs
+// its own. Passing a call to next adds it to the batch, which is sent with
+// ctx once every call has either been passed to next or been finished by an
+// interceptor; next then returns the call's outcome. A call passed to next
+// again once the batch has been sent is sent on its own.
+func (c *Client) CallBatch(ctx context.Context, b *Batch) error {
+	if len(b.Calls) == 0 {
+		return nil
+	}
+	if len(c.interceptors) > 0 {
+		return c.interceptBatch(ctx, b)
+	}
+	return c.sendBatch(ctx, b)
+}
+
+// sendBatch sends the calls of b as one request, beneath any interceptors.
+func (c *Client) sendBatch(ctx context.Context, b *Batch) error {
+	call := &PendingCall{Method: "batch", Done: make(chan *PendingCall, 1), batch: b}
+	c.start(ctx, call)
+	<-call.Done
+	if call.Error != nil {
+		for _, bc := range b.Calls {
+			bc.Error = call.Error
+		}
+	}
+	return call.Error
+}
+
+// interceptBatch runs the client's interceptors around each call of b, each
+// on its own goroutine, and sends the calls that reach the end of the chain
+// as one batch.
+func (c *Client) interceptBatch(ctx context.Context, b *Batch) error {
+	var (
+		m        sync.Mutex
+		batch    Batch
+		sent     bool
+		err      error
+		settled  = make(chan struct{}, len(b.Calls))
+		answered = make(chan struct{})
+		wg       sync.WaitGroup
+	)
+	for _, bc := range b.Calls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var queued *BatchCall
+			invoker := func(ctx context.Context, info RequestInfo, args, reply any) error {
+				m.Lock()
+				if sent || queued != nil {
+					m.Unlock()
+					return c.invoke(ctx, info, args, reply)
+				}
+				queued = batch.Add(info.Method, args, reply)
+				m.Unlock()
+				settled <- struct{}{}
+				<-answered
+				return queued.Error
+			}
+			info := RequestInfo{Method: bc.Method, Peer: c.address}
+			bc.Error = chainInvoker(c.interceptors, invoker)(ctx, info, bc.Args, bc.Reply)
+			m.Lock()
+			skipped := queued == nil
+			m.Unlock()
+			if skipped {
+				settled <- struct{}{}
+			}
+		}()
+	}
+	for range b.Calls {
+		<-settled
+	}
+	m.Lock()
+	sent = true
+	m.Unlock()
+	if len(batch.Calls) > 0 {
+		err = c.sendBatch(ctx, &batch)
+	}
+	close(answered)
+	wg.Wait()
+	return err
+}
+
+// envelope returns the BatchRequest carrying the calls of b.
+func (b *Batch) envelope(seq uint64) BatchRequest {
+	calls := make([]Call, len(b.Calls))
+	for i, bc := range b.Calls {
+		calls[i] = Call{Seq: uint64(i), Method: bc.Method, Args: bc.Args}
+	}
+	return BatchRequest{Seq: seq, Calls: calls}
+}
+
+// fill decodes the replies to the calls of b.
+func (b *Batch) fill(replies []response) error {
+	if len(replies) != len(b.Calls) {
+		return fmt.Errorf("bsonrpc: batch of %d calls got %d replies", len(b.Calls), len(replies))
+	}
+	for i, bc := range b.Calls {
+		bc.Error = replies[i].err
+		if bc.Error == nil {
+			bc.Error = bson.Unmarshal(replies[i].result, bc.Reply)
+		}
+	}
+	return nil
+}
+
+// serveBatch runs the calls of a BatchRequest in order and returns their
+// BatchReply. A call that cannot be decoded gets an error reply without
+// affecting the others; if the calls cannot be read at all the batch is
+// answered with a single error Reply.
+func (s *Server) serveBatch(seq uint64, rawCalls *bson.Raw, signer ed25519.PublicKey, from peer) any {
+	calls, err := readArray(rawCalls)
+	if err != nil {
+		log.Println("Error parsing batch request: " + err.Error())
+		return Reply{
+			Seq:   seq,
+			Error: Error{Code: CodeInvalidRequest, Message: err.Error()},
+		}
+	}
+	reply := BatchReply{Seq: seq}
+	reply.Replies = make([]Reply, len(*calls))
+	for i, raw := range *calls {
+		call, err := decodeBatchEntry(raw)
+		if err != nil {
+			reply.Replies[i] = Reply{Seq: uint64(i), Error: Error{Code: CodeInvalidRequest, Message: err.Error()}}
+			continue
+		}
+		call.notify = false
+		call.signer = signer
+		reply.Replies[i] = s.serveCall(call, from)
+	}
+	return reply
+}
+
+func decodeBatchEntry(raw *bson.Raw) (incomingCall, error) {
+	if raw.Type != bson.Object {
+		return incomingCall{}, fmt.Errorf("batch entry is not a document")
+	}
+	doc, err := readRequest(raw.Data)
+	if err != nil {
+		return incomingCall{}, err
+	}
+	return decodeCall(doc)
+}
+
+// readArray reads the elements of an encoded array.
+func readArray(raw *bson.Raw) (*bson.RawArray, error) {
+	if raw == nil || raw.Type != bson.Array {
+		return nil, fmt.Errorf("not an array")
+	}
+	return bson.NewReader(raw.Data).ReadArray()
+}
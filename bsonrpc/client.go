@@ -1,55 +1,556 @@
 package bsonrpc
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"go-dht/bson"
+	"log"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 )
 
+// DefaultTimeout bounds calls made through Call, which carry no context.
+var DefaultTimeout = 5 * time.Second
+
+// ErrClientClosed is returned by calls made on, or still waiting on, a
+// client that has been closed.
+var ErrClientClosed = errors.New("bsonrpc: client is closed")
+
+// Client sends calls over a single UDP socket or TCP connection. Every call
+// carries a sequence number that the server echoes in its reply, and a read
+// loop hands each reply to the call waiting for it, so a Client may be used
+// by several goroutines at once. Replies nobody is waiting for, such as late
+// or duplicated ones, are dropped.
 type Client struct {
-	conn *net.UDPConn
+	t              transport
+	network        string
+	address        string
+	packets        Network
+	maxMessageSize int
+	interceptors   []ClientInterceptor
+	key            ed25519.PrivateKey
+	encrypt        bool
+	m              sync.Mutex
+	seq            uint64
+	pending        map[uint64]*PendingCall
+	lastActive     time.Time
+	closed         bool
+	session        *session
+	handshaking    chan struct{}
+}
+
+type ClientOption func(*Client)
+
+// WithClientNetwork makes the client send datagrams through nw instead of
+// real UDP sockets. TCP cannot be dialed on such a client.
+func WithClientNetwork(nw Network) ClientOption {
+	return func(c *Client) {
+		c.packets = nw
+	}
+}
+
+// WithClientMaxMessageSize sets the size above which requests are not sent
+// and replies are refused with ErrMessageTooLarge.
+func WithClientMaxMessageSize(n int) ClientOption {
+	return func(c *Client) {
+		c.maxMessageSize = n
+	}
 }
 
+// Call is the envelope of a request. The server answers it with a Reply
+// carrying the same Seq, unless Notify is set.
 type Call struct {
+	Seq    uint64
 	Method string
 	Args   any
+	Notify bool
 }
 
-func (c Client) Call(methodName string, args any, reply any) error {
-	call := Call{Method: methodName, Args: args}
+// Reply is the envelope the server sends back for a Call. It carries either
+// the Result of the method or an Error, never both.
+type Reply struct {
+	Seq    uint64
+	Result any
+	Error  any
+}
 
-	bytes, err := bson.Marshal(call)
-	if err != nil {
-		return err
+// response is a decoded Reply on its way to the call waiting for it. The
+// replies of a BatchReply are each decoded into a response of their own.
+type response struct {
+	result    []byte
+	err       error
+	replies   []response
+	signer    ed25519.PublicKey
+	session   *session
+	inReplyTo []byte
+}
+
+// PendingCall is a call started with Go. Once it completes it is sent on
+// Done, with Error set if it failed and Reply holding the result otherwise.
+type PendingCall struct {
+	Method string
+	Args   any
+	Reply  any
+	Error  error
+	Done   chan *PendingCall
+
+	stop        func() bool
+	cancel      context.CancelFunc
+	batch       *Batch
+	checkSigner func(ed25519.PublicKey) error
+
+	// ctx and session are those the call was last sent with, and nonce that
+	// of the signed request it was last sent as, set under Client.m. plain
+	// calls, such as the handshake, are sent in the clear on encrypting
+	// clients.
+	ctx     context.Context
+	session *session
+	nonce   []byte
+	plain   bool
+	retried bool
+}
+
+// finish records the outcome of the call and sends it on Done. It must be
+// called exactly once, by whoever removed the call from Client.pending.
+func (call *PendingCall) finish(resp response) {
+	call.Error = resp.err
+	var rpcErr *Error
+	if call.checkSigner != nil && (resp.err == nil || errors.As(resp.err, &rpcErr)) {
+		if err := call.checkSigner(resp.signer); err != nil {
+			call.Error = err
+		}
+	}
+	switch {
+	case call.Error != nil:
+	case call.batch != nil && resp.replies == nil:
+		call.Error = errors.New("bsonrpc: batch answered with a single reply")
+	case call.batch != nil:
+		call.Error = call.batch.fill(resp.replies)
+	default:
+		call.Error = bson.Unmarshal(resp.result, call.Reply)
+	}
+	call.done()
+}
+
+func (call *PendingCall) done() {
+	if call.stop != nil {
+		call.stop()
+	}
+	if call.cancel != nil {
+		call.cancel()
+	}
+	select {
+	case call.Done <- call:
+	default:
+		log.Printf("Dropping reply to %s: done channel is full", call.Method)
+	}
+}
+
+func (c *Client) Call(methodName string, args any, reply any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	return c.CallContext(ctx, methodName, args, reply)
+}
+
+// CallContext is like Call but gives up waiting for the reply once ctx is
+// cancelled or its deadline passes.
+func (c *Client) CallContext(ctx context.Context, methodName string, args any, reply any) error {
+	info := RequestInfo{Method: methodName, Peer: c.address}
+	return chainInvoker(c.interceptors, c.invoke)(ctx, info, args, reply)
+}
+
+// Go starts a call without waiting for its reply and returns it; the call is
+// sent on done once it completes or DefaultTimeout passes. done must be
+// buffered; if it is nil a new channel is allocated.
+func (c *Client) Go(methodName string, args any, reply any, done chan *PendingCall) *PendingCall {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	return c.goContext(ctx, cancel, methodName, args, reply, done)
+}
+
+// GoContext is like Go but fails the call once ctx is cancelled or its
+// deadline passes.
+//
+// Without interceptors the call costs no goroutine while it is pending: the
+// client's read loop completes it. With interceptors, which are synchronous,
+// the call runs them on a goroutine of its own.
+func (c *Client) GoContext(ctx context.Context, methodName string, args any, reply any, done chan *PendingCall) *PendingCall {
+	return c.goContext(ctx, nil, methodName, args, reply, done)
+}
+
+func (c *Client) goContext(ctx context.Context, cancel context.CancelFunc, methodName string, args any, reply any, done chan *PendingCall) *PendingCall {
+	if done == nil {
+		done = make(chan *PendingCall, 1)
+	} else if cap(done) == 0 {
+		panic("bsonrpc: done channel is unbuffered")
+	}
+	call := &PendingCall{Method: methodName, Args: args, Reply: reply, Done: done, cancel: cancel}
+	if len(c.interceptors) == 0 {
+		c.start(ctx, call)
+		return call
 	}
+	go func() {
+		info := RequestInfo{Method: methodName, Peer: c.address}
+		call.Error = chainInvoker(c.interceptors, c.invoke)(ctx, info, args, reply)
+		call.done()
+	}()
+	return call
+}
+
+// Notify sends a call that the server runs without replying to. It returns
+// once the call has been sent; whether the method ran or failed is unknown
+// to the caller.
+func (c *Client) Notify(methodName string, args any) error {
+	info := RequestInfo{Method: methodName, Peer: c.address, Notify: true}
+	return chainInvoker(c.interceptors, c.invoke)(context.Background(), info, args, nil)
+}
 
-	_, err = c.conn.Write(bytes)
+// invoke sends a call and waits for its reply, beneath any interceptors.
+func (c *Client) invoke(ctx context.Context, info RequestInfo, args any, reply any) error {
+	if info.Notify {
+		return c.notify(info.Method, args)
+	}
+	call := &PendingCall{Method: info.Method, Args: args, Reply: reply, Done: make(chan *PendingCall, 1)}
+	c.start(ctx, call)
+	<-call.Done
+	return call.Error
+}
+
+// start sends call and arranges for it to be completed by its reply, by ctx
+// ending, or by the client closing, whichever comes first. If ctx carries a
+// signer check, the reply must pass it. On an encrypting client without a
+// session, the call is sent once the handshake is done.
+func (c *Client) start(ctx context.Context, call *PendingCall) {
+	call.ctx = ctx
+	call.checkSigner = signerCheck(ctx)
+	if err := ctx.Err(); err != nil {
+		call.finish(response{err: err})
+		return
+	}
+	if c.encrypt && !call.plain {
+		call.session = c.currentSession()
+		if call.session == nil {
+			go func() {
+				sess, err := c.establish(ctx)
+				if err != nil {
+					call.finish(response{err: err})
+					return
+				}
+				call.session = sess
+				c.send(ctx, call)
+			}()
+			return
+		}
+	}
+	c.send(ctx, call)
+}
+
+// send registers call and sends it through its session, if any.
+func (c *Client) send(ctx context.Context, call *PendingCall) {
+	seq, err := c.register(ctx, call)
 	if err != nil {
-		return err
+		call.finish(response{err: err})
+		return
+	}
+	var envelope any = Call{Seq: seq, Method: call.Method, Args: call.Args}
+	if call.batch != nil {
+		envelope = call.batch.envelope(seq)
+	}
+	bytes, nonce, err := c.encodeCall(envelope, call.session, recipient(ctx))
+	if err == nil {
+		c.m.Lock()
+		call.nonce = nonce
+		c.m.Unlock()
+		err = c.t.send(seq, bytes)
 	}
+	if err != nil && c.unregister(seq) {
+		call.finish(response{err: err})
+	}
+}
 
-	buf := make([]byte, 2048)
-	n, _, err := c.conn.ReadFromUDP(buf)
+func (c *Client) notify(methodName string, args any) error {
+	c.m.Lock()
+	if c.closed {
+		c.m.Unlock()
+		return ErrClientClosed
+	}
+	c.seq++
+	seq := c.seq
+	c.m.Unlock()
+
+	var sess *session
+	if c.encrypt {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		defer cancel()
+		var err error
+		if sess, err = c.establish(ctx); err != nil {
+			return err
+		}
+	}
+	bytes, _, err := c.encodeCall(Call{Seq: seq, Method: methodName, Args: args, Notify: true}, sess, nil)
 	if err != nil {
 		return err
 	}
+	return c.t.send(seq, bytes)
+}
 
-	err = bson.Unmarshal(buf[:n], reply)
+// encodeCall encodes a Call or BatchRequest and encrypts it for sess or, if
+// sess is nil, signs it for recipient if the client has a signing key, in
+// which case the nonce it was signed with is returned too.
+func (c *Client) encodeCall(envelope any, sess *session, recipient ed25519.PublicKey) ([]byte, []byte, error) {
+	bytes, err := bson.Marshal(envelope)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	if sess != nil {
+		sealed, err := sess.seal(bytes)
+		return sealed, nil, err
+	}
+	return seal(c.key, requestContext, recipient, nil, bytes)
+}
+
+// Network returns the network the client was dialed on, UDP or TCP.
+func (c *Client) Network() string {
+	return c.network
+}
+
+// Close closes the connection. Calls still waiting for a reply fail with
+// ErrClientClosed.
+func (c *Client) Close() error {
+	c.m.Lock()
+	if c.closed {
+		c.m.Unlock()
+		return nil
 	}
+	c.closed = true
+	c.m.Unlock()
+	return c.t.Close()
+}
+
+func (c *Client) isClosed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.closed
+}
+
+// register adds call to the pending calls and fails it once ctx ends. The
+// lock is held until both are done, so that a reply cannot finish the call
+// before it can stop watching ctx.
+func (c *Client) register(ctx context.Context, call *PendingCall) (uint64, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
 
-	return nil
+	if c.closed {
+		return 0, ErrClientClosed
+	}
+	c.seq++
+	seq := c.seq
+	c.pending[seq] = call
+	c.lastActive = time.Now()
+	call.stop = context.AfterFunc(ctx, func() {
+		if c.unregister(seq) {
+			call.finish(response{err: ctx.Err()})
+		}
+	})
+	return seq, nil
+}
+
+// unregister removes a pending call, reporting whether it was still there,
+// in which case the caller is the one to finish it.
+func (c *Client) unregister(seq uint64) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	_, ok := c.pending[seq]
+	delete(c.pending, seq)
+	c.lastActive = time.Now()
+	return ok
+}
+
+// idleSince returns when the client last started or finished a call, and
+// false while a call or handshake is in flight.
+func (c *Client) idleSince() (time.Time, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if len(c.pending) > 0 || c.handshaking != nil {
+		return time.Time{}, false
+	}
+	return c.lastActive, true
+}
+
+// readLoop hands replies to the calls waiting for them until the transport
+// fails or is closed, then fails the calls still waiting.
+func (c *Client) readLoop() {
+	for {
+		seq, data, err := c.t.recv()
+		var resp response
+		if errors.Is(err, ErrMessageTooLarge) {
+			resp.err = ErrMessageTooLarge
+		} else if err != nil {
+			break
+		} else {
+			var signed SignedMessage
+			var sess *session
+			signed, sess, err = c.openReply(data)
+			if err == nil {
+				seq, resp, err = decodeReply(signed.Payload)
+			}
+			if err != nil {
+				log.Println("Error parsing reply: " + err.Error())
+				continue
+			}
+			resp.signer, resp.session, resp.inReplyTo = signed.Key, sess, signed.InReplyTo
+		}
+
+		c.m.Lock()
+		call, ok := c.pending[seq]
+		delete(c.pending, seq)
+		c.lastActive = time.Now()
+		c.m.Unlock()
+		if ok {
+			c.complete(call, resp)
+		}
+	}
+	c.t.Close()
+
+	c.m.Lock()
+	c.closed = true
+	pending := c.pending
+	c.pending = make(map[uint64]*PendingCall)
+	c.m.Unlock()
+	for _, call := range pending {
+		call.finish(response{err: ErrClientClosed})
+	}
 }
 
-func Dial(host string, port int) (*Client, error) {
-	serverAddr, err := net.ResolveUDPAddr("udp", host+":"+strconv.Itoa(port))
+// complete finishes call with resp, unless resp says the server has
+// forgotten the call's session, in which case the call is sent once more
+// over a new session. An encrypted call accepts replies in the clear only
+// if they report an error, as the server sends those before it decrypts,
+// and for the same reason a signed call only accepts a signed reply that
+// does not carry the call's nonce if it reports an error.
+func (c *Client) complete(call *PendingCall, resp response) {
+	var rpcErr *Error
+	if call.session != nil && !call.retried && errors.As(resp.err, &rpcErr) && rpcErr.Code == CodeUnknownSession {
+		c.dropSession(call.session)
+		call.retried = true
+		if call.stop != nil {
+			call.stop()
+		}
+		c.start(call.ctx, call)
+		return
+	}
+	if call.session != nil && resp.session != call.session && resp.err == nil {
+		resp = response{err: ErrUnencrypted}
+	}
+	if call.nonce != nil && resp.session == nil && resp.signer != nil && resp.err == nil && !bytes.Equal(resp.inReplyTo, call.nonce) {
+		resp = response{err: ErrReplayed}
+	}
+	call.finish(resp)
+}
+
+// decodeReply reads the sequence number of a Reply and returns it along with
+// either the Error or a copy of the encoded Result, which is decoded into the
+// caller's reply once it reaches the waiting call.
+func decodeReply(data []byte) (uint64, response, error) {
+	doc, err := bson.NewReader(data).ReadDocument()
+	if err != nil {
+		return 0, response{}, err
+	}
+	seq, err := readSeq(doc)
+	if err != nil {
+		return 0, response{}, err
+	}
+	if rawErr, ok := doc.Pairs["Error"]; ok && rawErr.Type == bson.Object {
+		rpcErr := &Error{}
+		if err := bson.Unmarshal(rawErr.Data, rpcErr); err != nil {
+			return 0, response{}, err
+		}
+		return seq, response{err: rpcErr}, nil
+	}
+	if rawReplies, ok := doc.Pairs["Replies"]; ok {
+		replies, err := decodeReplies(rawReplies)
+		if err != nil {
+			return 0, response{}, err
+		}
+		return seq, response{replies: replies}, nil
+	}
+	rawResult, ok := doc.Pairs["Result"]
+	if !ok || rawResult.Type != bson.Object {
+		return 0, response{}, errors.New("reply has no result")
+	}
+	return seq, response{result: append([]byte(nil), rawResult.Data...)}, nil
+}
+
+// decodeReplies decodes the Replies of a BatchReply.
+func decodeReplies(raw *bson.Raw) ([]response, error) {
+	elems, err := readArray(raw)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.DialUDP("udp", nil, serverAddr)
+	replies := make([]response, len(*elems))
+	for i, elem := range *elems {
+		if elem.Type != bson.Object {
+			return nil, errors.New("batch reply is not a document")
+		}
+		if _, replies[i], err = decodeReply(elem.Data); err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// readSeq returns the Seq field of a decoded Call or Reply.
+func readSeq(doc *bson.RawD) (uint64, error) {
+	rawSeq, ok := doc.Pairs["Seq"]
+	if !ok {
+		return 0, errors.New("no sequence number")
+	}
+	var seq uint64
+	var err error
+	switch rawSeq.Type {
+	case bson.Int:
+		var v int32
+		err = rawSeq.Unmarshal(&v)
+		seq = uint64(v)
+	case bson.Long:
+		var v int64
+		err = rawSeq.Unmarshal(&v)
+		seq = uint64(v)
+	default:
+		err = errors.New("invalid sequence number")
+	}
+	return seq, err
+}
+
+// Dial connects to the server at host:port over UDP.
+func Dial(host string, port int, opts ...ClientOption) (*Client, error) {
+	return DialNetwork(UDP, host, port, opts...)
+}
+
+// DialNetwork connects to the server at host:port over network, UDP or TCP.
+func DialNetwork(network, host string, port int, opts ...ClientOption) (*Client, error) {
+	c := &Client{
+		network:        network,
+		address:        net.JoinHostPort(host, strconv.Itoa(port)),
+		packets:        UDPNetwork,
+		maxMessageSize: DefaultMaxMessageSize,
+		pending:        make(map[uint64]*PendingCall),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.encrypt && c.key == nil {
+		return nil, errors.New("bsonrpc: encryption requires a signing key")
+	}
+	t, err := dialTransport(c.packets, network, host, port, c.maxMessageSize)
 	if err != nil {
 		return nil, err
 	}
-	return &Client{conn}, nil
+	c.t = t
+	go c.readLoop()
+	return c, nil
 }
@@ -0,0 +1,414 @@
+package bsonrpc
+
+import (
+	"context"
+	"errors"
+	"go-dht/bson"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type EchoArgs struct {
+	N int64
+}
+
+type EchoReply struct {
+	N int64
+}
+
+type Echo struct {
+	release chan struct{}
+}
+
+func (e *Echo) Echo(args EchoArgs, reply *EchoReply) error {
+	reply.N = args.N
+	return nil
+}
+
+func (e *Echo) Fail(args EchoArgs, reply *EchoReply) error {
+	return errors.New("failed")
+}
+
+func (e *Echo) Panic(args EchoArgs, reply *EchoReply) error {
+	panic("echo panicked")
+}
+
+// Block waits until the test releases it, then echoes like Echo.
+func (e *Echo) Block(args EchoArgs, reply *EchoReply) error {
+	<-e.release
+	reply.N = args.N
+	return nil
+}
+
+func newEchoServer(t *testing.T, opts ...ServerOption) *Server {
+	s, err := NewServer("127.0.0.1", 0, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register(&Echo{release: make(chan struct{})}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Listen()
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+func TestClient_ConcurrentCalls(t *testing.T) {
+	s := newEchoServer(t)
+	c, err := Dial("127.0.0.1", s.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := int64(0); i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply EchoReply
+			if err := c.Call("Echo.Echo", EchoArgs{N: i}, &reply); err != nil {
+				t.Error(err)
+				return
+			}
+			if reply.N != i {
+				t.Errorf("Call %d got the reply to call %d", i, reply.N)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClient_RoutesRepliesBySeq(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Answer two calls in reverse order, sending the first reply twice.
+	go func() {
+		var calls []Call
+		var addr *net.UDPAddr
+		buf := make([]byte, 2048)
+		for len(calls) < 2 {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, payload, err := parseFragment(buf[:n])
+			if err != nil {
+				return
+			}
+			m := bson.M{}
+			if err := bson.Unmarshal(payload, &m); err != nil {
+				return
+			}
+			seq, _ := m["Seq"].(int32)
+			args, _ := m["Args"].(bson.M)
+			calls = append(calls, Call{Seq: uint64(seq), Args: args["N"]})
+			addr = from
+		}
+		for _, i := range []int{1, 0, 0} {
+			data, _ := bson.Marshal(Reply{Seq: calls[i].Seq, Result: bson.M{"N": calls[i].Args}})
+			datagrams, _ := fragment(calls[i].Seq, data, DefaultMaxMessageSize)
+			conn.WriteToUDP(datagrams[0], addr)
+		}
+	}()
+
+	c, err := Dial("127.0.0.1", conn.LocalAddr().(*net.UDPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := int64(1); i <= 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply EchoReply
+			if err := c.Call("Echo.Echo", EchoArgs{N: i}, &reply); err != nil {
+				t.Error(err)
+				return
+			}
+			if reply.N != i {
+				t.Errorf("Call %d got the reply to call %d", i, reply.N)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClient_ReturnsServerErrors(t *testing.T) {
+	s := newEchoServer(t)
+	c, err := Dial("127.0.0.1", s.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tests := []struct {
+		method string
+		args   any
+		code   int
+	}{
+		{"Echo.Fail", EchoArgs{N: 1}, CodeHandler},
+		{"Echo.Missing", EchoArgs{N: 1}, CodeMethodNotFound},
+		{"Echo.Echo", "not echo args", CodeInvalidRequest},
+	}
+	for _, tt := range tests {
+		var reply EchoReply
+		err := c.Call(tt.method, tt.args, &reply)
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) || rpcErr.Code != tt.code {
+			t.Errorf("%s should fail with code %d, got %v", tt.method, tt.code, err)
+		}
+	}
+}
+
+func TestServer_RepliesToMalformedRequests(t *testing.T) {
+	s := newEchoServer(t)
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.Port()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	datagrams, _ := fragment(7, []byte{0xff, 0, 0, 0, 3, 'x'}, DefaultMaxMessageSize)
+	if _, err := conn.Write(datagrams[0]); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, err := parseFragment(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, resp, err := decodeReply(payload)
+	var rpcErr *Error
+	if err != nil || seq != 7 || !errors.As(resp.err, &rpcErr) || rpcErr.Code != CodeInvalidRequest {
+		t.Errorf("A malformed request should get an invalid request error, got %v (%v)", resp.err, err)
+	}
+}
+
+func TestServer_DecodesArgsIntoDeclaredType(t *testing.T) {
+	s := newEchoServer(t)
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.Port()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A request built from plain documents registers no Go types, like one
+	// sent by a client in another process.
+	data, err := bson.Marshal(bson.M{
+		"Seq":    int64(9),
+		"Method": "Echo.Echo",
+		"Args":   bson.M{"N": int64(5)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagrams, _ := fragment(9, data, DefaultMaxMessageSize)
+	if _, err := conn.Write(datagrams[0]); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, err := parseFragment(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, resp, err := decodeReply(payload)
+	if err != nil || resp.err != nil {
+		t.Fatalf("Echo.Echo failed: %v (%v)", resp.err, err)
+	}
+	var reply EchoReply
+	if err := bson.Unmarshal(resp.result, &reply); err != nil || seq != 9 || reply.N != 5 {
+		t.Errorf("Echo.Echo = %v (%v), want 5", reply, err)
+	}
+}
+
+func TestClient_Go(t *testing.T) {
+	s := newEchoServer(t)
+	c := dialEcho(t, s)
+
+	done := make(chan *PendingCall, 10)
+	replies := make([]EchoReply, 10)
+	for i := range replies {
+		c.Go("Echo.Echo", EchoArgs{N: int64(i)}, &replies[i], done)
+	}
+	for range replies {
+		call := <-done
+		if call.Error != nil {
+			t.Errorf("%s failed: %s", call.Method, call.Error)
+		}
+	}
+	for i, reply := range replies {
+		if reply.N != int64(i) {
+			t.Errorf("Reply %d = %d", i, reply.N)
+		}
+	}
+
+	call := <-c.Go("Echo.Fail", EchoArgs{N: 1}, &EchoReply{}, nil).Done
+	var rpcErr *Error
+	if !errors.As(call.Error, &rpcErr) || rpcErr.Code != CodeHandler {
+		t.Errorf("A failing call should complete with its error, got %v", call.Error)
+	}
+}
+
+func TestClient_GoContextCancelled(t *testing.T) {
+	s := newEchoServer(t)
+	c := dialEcho(t, s)
+	defer close(echoService(s).release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	call := c.GoContext(ctx, "Echo.Block", EchoArgs{N: 1}, &EchoReply{}, nil)
+	cancel()
+	select {
+	case call = <-call.Done:
+		if !errors.Is(call.Error, context.Canceled) {
+			t.Errorf("A cancelled call should fail with %v, got %v", context.Canceled, call.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("A cancelled call should complete straight away")
+	}
+}
+
+func TestClient_Notify(t *testing.T) {
+	notified := make(chan RequestInfo, 1)
+	s := newEchoServer(t, WithInterceptors(func(info RequestInfo, args any, next Handler) (any, error) {
+		reply, err := next(args)
+		if info.Notify {
+			notified <- info
+		}
+		return reply, err
+	}))
+	c := dialEcho(t, s)
+
+	if err := c.Notify("Echo.Echo", EchoArgs{N: 1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case info := <-notified:
+		if info.Method != "Echo.Echo" {
+			t.Errorf("Notified %s, want Echo.Echo", info.Method)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The server should run notifications")
+	}
+
+	// The server does not reply to notifications, so the only reply on the
+	// socket is the one for this call.
+	var reply EchoReply
+	if err := c.Call("Echo.Echo", EchoArgs{N: 2}, &reply); err != nil || reply.N != 2 {
+		t.Errorf("Echo.Echo = %v (%v), want 2", reply, err)
+	}
+}
+
+func TestServer_DoesNotReplyToNotifications(t *testing.T) {
+	s := newEchoServer(t)
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.Port()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data, err := bson.Marshal(Call{Seq: 3, Method: "Echo.Echo", Args: EchoArgs{N: 1}, Notify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagrams, _ := fragment(3, data, DefaultMaxMessageSize)
+	if _, err := conn.Write(datagrams[0]); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 2048)); err == nil {
+		t.Errorf("The server should not reply to a notification")
+	}
+}
+
+func TestClient_CallBatch(t *testing.T) {
+	s := newEchoServer(t)
+	c := dialEcho(t, s)
+
+	var b Batch
+	var replies [3]EchoReply
+	first := b.Add("Echo.Echo", EchoArgs{N: 1}, &replies[0])
+	failed := b.Add("Echo.Fail", EchoArgs{N: 2}, &replies[1])
+	missing := b.Add("Echo.Missing", EchoArgs{N: 3}, &EchoReply{})
+	last := b.Add("Echo.Echo", EchoArgs{N: 4}, &replies[2])
+	if err := c.CallBatch(context.Background(), &b); err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Error != nil || replies[0].N != 1 || last.Error != nil || replies[2].N != 4 {
+		t.Errorf("Replies should match their calls, got %v (%v) and %v (%v)", replies[0], first.Error, replies[2], last.Error)
+	}
+	var rpcErr *Error
+	if !errors.As(failed.Error, &rpcErr) || rpcErr.Code != CodeHandler {
+		t.Errorf("Echo.Fail should fail on its own, got %v", failed.Error)
+	}
+	if !errors.As(missing.Error, &rpcErr) || rpcErr.Code != CodeMethodNotFound {
+		t.Errorf("Echo.Missing should not be found, got %v", missing.Error)
+	}
+}
+
+func TestClient_CallBatchRunsInterceptors(t *testing.T) {
+	s := newEchoServer(t)
+	var m sync.Mutex
+	var seen []int64
+	c, err := Dial("127.0.0.1", s.Port(), WithClientInterceptors(func(ctx context.Context, i RequestInfo, args, reply any, next Invoker) error {
+		n := args.(EchoArgs).N
+		m.Lock()
+		seen = append(seen, n)
+		m.Unlock()
+		if n < 0 {
+			return errors.New("rejected")
+		}
+		return next(ctx, i, EchoArgs{N: 2 * n}, reply)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var b Batch
+	var replies [2]EchoReply
+	first := b.Add("Echo.Echo", EchoArgs{N: 1}, &replies[0])
+	rejected := b.Add("Echo.Echo", EchoArgs{N: -1}, &EchoReply{})
+	last := b.Add("Echo.Echo", EchoArgs{N: 2}, &replies[1])
+	if err := c.CallBatch(context.Background(), &b); err != nil {
+		t.Fatal(err)
+	}
+	m.Lock()
+	if len(seen) != 3 {
+		t.Errorf("The interceptor should see every call in the batch, saw %v", seen)
+	}
+	m.Unlock()
+	if first.Error != nil || replies[0].N != 2 || last.Error != nil || replies[1].N != 4 {
+		t.Errorf("Calls should be sent with the arguments the interceptor passed on, got %v (%v) and %v (%v)", replies[0], first.Error, replies[1], last.Error)
+	}
+	if rejected.Error == nil || rejected.Error.Error() != "rejected" {
+		t.Errorf("An interceptor should be able to fail a call of the batch, got %v", rejected.Error)
+	}
+}
+
+func TestClient_CallBatchEmpty(t *testing.T) {
+	s := newEchoServer(t)
+	c := dialEcho(t, s)
+	if err := c.CallBatch(context.Background(), &Batch{}); err != nil {
+		t.Errorf("An empty batch should succeed without a request, got %v", err)
+	}
+}
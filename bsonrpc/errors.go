@@ -0,0 +1,56 @@
+package bsonrpc
+
+import "fmt"
+
+// Error codes carried in the Error of a Reply.
+const (
+	// CodeInvalidRequest means the request could not be decoded.
+	CodeInvalidRequest = 1
+	// CodeMethodNotFound means no registered method has the requested name.
+	CodeMethodNotFound = 2
+	// CodeHandler means the method ran and returned an error.
+	CodeHandler = 3
+	// CodeInternal means the server could not encode the reply.
+	CodeInternal = 4
+	// CodeBusy means the server's queue was full and the request was not run.
+	CodeBusy = 5
+	// CodeTooLarge means the request or its reply exceeded the maximum
+	// message size.
+	CodeTooLarge = 6
+	// CodeUnknownSession means the request was encrypted for a session the
+	// server does not have, for example because it expired.
+	CodeUnknownSession = 7
+)
+
+// Error is an error reported by the server in place of a result. Client
+// calls return it as a *Error, so callers can inspect the code with
+// errors.As.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	switch e.Code {
+	case CodeInvalidRequest:
+		return "bsonrpc: invalid request: " + e.Message
+	case CodeMethodNotFound:
+		return "bsonrpc: method not found: " + e.Message
+	case CodeInternal:
+		return "bsonrpc: internal error: " + e.Message
+	case CodeBusy:
+		return "bsonrpc: " + e.Message
+	case CodeTooLarge:
+		return ErrMessageTooLarge.Error() + ": " + e.Message
+	case CodeUnknownSession:
+		return "bsonrpc: unknown session: " + e.Message
+	case CodeHandler:
+		return e.Message
+	}
+	return fmt.Sprintf("bsonrpc: error %d: %s", e.Code, e.Message)
+}
+
+// Is makes errors.Is(err, ErrMessageTooLarge) hold for CodeTooLarge errors.
+func (e *Error) Is(target error) bool {
+	return target == ErrMessageTooLarge && e.Code == CodeTooLarge
+}
@@ -0,0 +1,173 @@
+package bsonrpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Messages are sent as one or more datagrams, each starting with a header
+// that carries the sequence number of the call, the total size of the
+// message, and the index and count of the fragment:
+//
+//	[seq uint64][size uint32][index uint16][count uint16][payload]
+const (
+	fragmentHeaderSize = 16
+	maxDatagramSize    = 1400
+	maxFragmentPayload = maxDatagramSize - fragmentHeaderSize
+)
+
+// DefaultMaxMessageSize bounds the size of an encoded request or reply for
+// servers and clients that are not given another limit.
+var DefaultMaxMessageSize = 1 << 20
+
+// ReassemblyTimeout is how long the fragments of a message are kept while
+// waiting for the rest of them.
+var ReassemblyTimeout = 10 * time.Second
+
+// ErrMessageTooLarge is returned for messages bigger than the allowed
+// maximum, either when sending them or when the peer refuses them.
+var ErrMessageTooLarge = errors.New("bsonrpc: message too large")
+
+// maxPartialMessages bounds how many incomplete messages are buffered at once.
+const maxPartialMessages = 256
+
+type fragmentHeader struct {
+	seq   uint64
+	size  int
+	index int
+	count int
+}
+
+// fragment splits a message into datagrams.
+func fragment(seq uint64, data []byte, maxSize int) ([][]byte, error) {
+	if len(data) > maxSize {
+		return nil, ErrMessageTooLarge
+	}
+	count := (len(data) + maxFragmentPayload - 1) / maxFragmentPayload
+	if count == 0 {
+		count = 1
+	}
+	if count > 0xffff {
+		return nil, ErrMessageTooLarge
+	}
+	datagrams := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		chunk := data[i*maxFragmentPayload : min((i+1)*maxFragmentPayload, len(data))]
+		d := make([]byte, fragmentHeaderSize+len(chunk))
+		binary.LittleEndian.PutUint64(d[0:8], seq)
+		binary.LittleEndian.PutUint32(d[8:12], uint32(len(data)))
+		binary.LittleEndian.PutUint16(d[12:14], uint16(i))
+		binary.LittleEndian.PutUint16(d[14:16], uint16(count))
+		copy(d[fragmentHeaderSize:], chunk)
+		datagrams = append(datagrams, d)
+	}
+	return datagrams, nil
+}
+
+// parseFragment reads the header of a datagram. The count and the length of
+// the payload must be the ones fragment would have produced for a message of
+// the given size, so that a header cannot make the reassembler set aside room
+// for more fragments than the message can have.
+func parseFragment(d []byte) (fragmentHeader, []byte, error) {
+	if len(d) < fragmentHeaderSize {
+		return fragmentHeader{}, nil, errors.New("datagram shorter than fragment header")
+	}
+	h := fragmentHeader{
+		seq:   binary.LittleEndian.Uint64(d[0:8]),
+		size:  int(binary.LittleEndian.Uint32(d[8:12])),
+		index: int(binary.LittleEndian.Uint16(d[12:14])),
+		count: int(binary.LittleEndian.Uint16(d[14:16])),
+	}
+	count := max(1, (h.size+maxFragmentPayload-1)/maxFragmentPayload)
+	if h.count != count || h.index >= h.count {
+		return fragmentHeader{}, nil, fmt.Errorf("invalid fragment %d/%d of %d bytes", h.index, h.count, h.size)
+	}
+	payload := d[fragmentHeaderSize:]
+	if len(payload) != min(maxFragmentPayload, h.size-h.index*maxFragmentPayload) {
+		return fragmentHeader{}, nil, errors.New("fragment size mismatch")
+	}
+	return h, payload, nil
+}
+
+type partialMessage struct {
+	chunks   [][]byte
+	received int
+	started  time.Time
+}
+
+// reassembler collects fragments until every one of a message has arrived.
+// Messages are keyed by sender and sequence number. It is not safe for
+// concurrent use; each connection reads on a single goroutine.
+type reassembler struct {
+	maxSize   int
+	partial   map[string]*partialMessage
+	lastSweep time.Time
+}
+
+func newReassembler(maxSize int) *reassembler {
+	return &reassembler{maxSize: maxSize, partial: make(map[string]*partialMessage)}
+}
+
+// add records one datagram from sender. It returns the complete message once
+// its last fragment arrives, and nil while fragments are still missing. A
+// message larger than the maximum size yields ErrMessageTooLarge on its
+// first fragment and is not buffered.
+func (r *reassembler) add(sender string, d []byte) (uint64, []byte, error) {
+	h, payload, err := parseFragment(d)
+	if err != nil {
+		return 0, nil, err
+	}
+	if h.size > r.maxSize {
+		if h.index == 0 {
+			return h.seq, nil, ErrMessageTooLarge
+		}
+		return h.seq, nil, nil
+	}
+	if h.count == 1 {
+		return h.seq, append([]byte(nil), payload...), nil
+	}
+
+	now := time.Now()
+	if now.Sub(r.lastSweep) > ReassemblyTimeout {
+		r.sweep(now)
+	}
+	key := fmt.Sprintf("%s/%d", sender, h.seq)
+	p, ok := r.partial[key]
+	if !ok {
+		if len(r.partial) >= maxPartialMessages {
+			return h.seq, nil, errors.New("too many partial messages")
+		}
+		p = &partialMessage{chunks: make([][]byte, h.count), started: now}
+		r.partial[key] = p
+	}
+	if len(p.chunks) != h.count {
+		delete(r.partial, key)
+		return h.seq, nil, errors.New("fragment count mismatch")
+	}
+	if p.chunks[h.index] != nil {
+		return h.seq, nil, nil
+	}
+	p.chunks[h.index] = append([]byte(nil), payload...)
+	p.received++
+	if p.received < h.count {
+		return h.seq, nil, nil
+	}
+
+	delete(r.partial, key)
+	data := make([]byte, 0, h.size)
+	for _, chunk := range p.chunks {
+		data = append(data, chunk...)
+	}
+	return h.seq, data, nil
+}
+
+func (r *reassembler) sweep(now time.Time) {
+	r.lastSweep = now
+	for key, p := range r.partial {
+		if now.Sub(p.started) > ReassemblyTimeout {
+			delete(r.partial, key)
+		}
+	}
+}
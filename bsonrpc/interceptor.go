@@ -0,0 +1,96 @@
+package bsonrpc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// RequestInfo describes the call an interceptor is wrapping.
+type RequestInfo struct {
+	// Method is the "Service.Method" name of the call.
+	Method string
+	// Peer is the address of the other end: the sender of the request on a
+	// server, the server being called on a client.
+	Peer string
+	// Notify is set for calls that expect no reply. On a client their reply
+	// is nil.
+	Notify bool
+	// Signer is the public key a request was signed with, or that of the
+	// client whose encrypted session it came through, and nil if neither.
+	// It is only set on servers.
+	Signer ed25519.PublicKey
+}
+
+// Handler runs a decoded request and returns its reply.
+type Handler func(args any) (any, error)
+
+// ServerInterceptor wraps the handling of every request that names a
+// registered method and whose arguments could be decoded. It may inspect or
+// replace args, call next any number of times or not at all, and inspect or
+// replace the reply and error that next returns. Arguments passed to next
+// must be of the method's argument type, or next returns an error with
+// CodeInvalidRequest. A panic in the method or an interceptor unwinds through
+// the interceptors and fails the call with CodeHandler.
+type ServerInterceptor func(info RequestInfo, args any, next Handler) (any, error)
+
+// Invoker sends a call and decodes its reply into reply.
+type Invoker func(ctx context.Context, info RequestInfo, args, reply any) error
+
+// ClientInterceptor wraps every call made by a Client, in the same way as
+// ServerInterceptor does on the server.
+type ClientInterceptor func(ctx context.Context, info RequestInfo, args, reply any, next Invoker) error
+
+// WithInterceptors adds interceptors around the server's handlers. The first
+// one given is the outermost.
+func WithInterceptors(interceptors ...ServerInterceptor) ServerOption {
+	return func(s *Server) {
+		s.interceptors = append(s.interceptors, interceptors...)
+	}
+}
+
+// WithClientInterceptors adds interceptors around the client's calls. The
+// first one given is the outermost.
+func WithClientInterceptors(interceptors ...ClientInterceptor) ClientOption {
+	return func(c *Client) {
+		c.interceptors = append(c.interceptors, interceptors...)
+	}
+}
+
+// chainHandler wraps handler in interceptors, the first one outermost.
+func chainHandler(interceptors []ServerInterceptor, info RequestInfo, handler Handler) Handler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(args any) (any, error) {
+			return interceptor(info, args, next)
+		}
+	}
+	return handler
+}
+
+// chainInvoker wraps invoker in interceptors, the first one outermost.
+func chainInvoker(interceptors []ClientInterceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, info RequestInfo, args, reply any) error {
+			return interceptor(ctx, info, args, reply, next)
+		}
+	}
+	return invoker
+}
+
+// recoverHandler turns a panic in handler into an error, so that a failing
+// method or interceptor answers its caller instead of killing the server.
+func recoverHandler(method string, handler Handler) Handler {
+	return func(args any) (reply any, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Panic handling %s: %v\n%s", method, r, debug.Stack())
+				reply, err = nil, fmt.Errorf("bsonrpc: %s panicked: %v", method, r)
+			}
+		}()
+		return handler(args)
+	}
+}
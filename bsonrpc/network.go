@@ -0,0 +1,51 @@
+package bsonrpc
+
+import (
+	"net"
+	"strconv"
+)
+
+// Network provides the packet sockets that servers listen on and clients
+// dial with. The default, UDPNetwork, uses real UDP sockets; an in-memory
+// implementation lets many servers run in one process without binding ports.
+type Network interface {
+	// ListenPacket opens a socket bound to host:port. A port of 0 picks a
+	// free one.
+	ListenPacket(host string, port int) (net.PacketConn, error)
+	// DialPacket opens a socket that sends to and receives from host:port
+	// only.
+	DialPacket(host string, port int) (net.Conn, error)
+}
+
+// UDPNetwork is the Network of real UDP sockets.
+var UDPNetwork Network = udpNetwork{}
+
+type udpNetwork struct{}
+
+func (udpNetwork) ListenPacket(host string, port int) (net.PacketConn, error) {
+	addr, err := net.ResolveUDPAddr(UDP, net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP(UDP, addr)
+}
+
+func (udpNetwork) DialPacket(host string, port int) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr(UDP, net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUDP(UDP, nil, addr)
+}
+
+// portOf returns the port of a socket's local address.
+func portOf(addr net.Addr) (int, error) {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp.Port, nil
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(port)
+}
@@ -0,0 +1,113 @@
+package bsonrpc
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Pool keeps one Client per network and address so that calls to the same
+// server share a connection, which matters most for TCP. Clients returned by
+// Get are shared: callers must not close them, but close the Pool instead.
+type Pool struct {
+	m       sync.Mutex
+	opts    []ClientOption
+	clients map[string]*pooledClient
+	closed  bool
+}
+
+type pooledClient struct {
+	*Client
+	lastUsed time.Time
+}
+
+// NewPool returns an empty Pool that dials new clients with opts.
+func NewPool(opts ...ClientOption) *Pool {
+	return &Pool{opts: opts, clients: make(map[string]*pooledClient)}
+}
+
+// Get returns the pooled client for host:port on network, dialing a new one
+// if there is none yet or the previous one has been closed, for example
+// because the server hung up.
+func (p *Pool) Get(network, host string, port int) (*Client, error) {
+	key := network + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+	p.m.Lock()
+	if p.closed {
+		p.m.Unlock()
+		return nil, ErrClientClosed
+	}
+	if c, ok := p.clients[key]; ok && !c.isClosed() {
+		c.lastUsed = time.Now()
+		p.m.Unlock()
+		return c.Client, nil
+	}
+	p.m.Unlock()
+
+	c, err := DialNetwork(network, host, port, p.opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.closed {
+		c.Close()
+		return nil, ErrClientClosed
+	}
+	if existing, ok := p.clients[key]; ok && !existing.isClosed() {
+		c.Close()
+		existing.lastUsed = time.Now()
+		return existing.Client, nil
+	}
+	p.clients[key] = &pooledClient{Client: c, lastUsed: time.Now()}
+	return c, nil
+}
+
+// CloseIdle closes and forgets the clients that have neither been returned
+// by Get nor had a call in flight for longer than maxIdle, as well as those
+// already closed, and returns how many were removed. Clients with calls in
+// flight are kept however long ago Get returned them.
+func (p *Pool) CloseIdle(maxIdle time.Duration) int {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	removed := 0
+	now := time.Now()
+	for key, c := range p.clients {
+		since, idle := c.idleSince()
+		if since.Before(c.lastUsed) {
+			since = c.lastUsed
+		}
+		if c.isClosed() || idle && now.Sub(since) > maxIdle {
+			c.Close()
+			delete(p.clients, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Len returns the number of pooled clients.
+func (p *Pool) Len() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return len(p.clients)
+}
+
+// Close closes every pooled client. Calls made on them afterwards fail with
+// ErrClientClosed.
+func (p *Pool) Close() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.closed = true
+	var err error
+	for key, c := range p.clients {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+		delete(p.clients, key)
+	}
+	return err
+}
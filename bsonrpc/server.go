@@ -1,20 +1,113 @@
 package bsonrpc
 
 import (
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"go-dht/bson"
 	"log"
 	"net"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// DefaultWorkers and DefaultQueueSize are the sizes of the worker pool and of
+// the queue in front of it used when a Server is given no options.
+var (
+	DefaultWorkers   = 16
+	DefaultQueueSize = 256
+)
+
+// Server handles requests on a pool of worker goroutines. Requests that
+// arrive while every worker is busy wait in a bounded queue; once the queue is
+// full, requests are answered straight away with a CodeBusy error so that the
+// caller can back off instead of waiting for a reply that never comes.
+//
+// A Server always listens on UDP and, when created with WithTCP, on TCP on
+// the same port as well.
 type Server struct {
-	host           string
-	port           int
-	conn           *net.UDPConn
-	serviceMethods map[string]*ServiceMethod
-	service        reflect.Value
+	host        string
+	port        int
+	conn        net.PacketConn
+	tcpListener net.Listener
+	network     Network
+	services    map[string]*service
+
+	tcp            bool
+	workers        int
+	queueSize      int
+	maxMessageSize int
+	interceptors   []ServerInterceptor
+	key            ed25519.PrivateKey
+	encrypt        bool
+	sessions       *sessionCache
+	nonces         *nonceCache
+	queue          chan request
+	wg             sync.WaitGroup
+	readers        sync.WaitGroup
+	done           chan struct{}
+	m              sync.Mutex
+	tcpConns       map[*tcpTransport]bool
+	listening      bool
+	shutdown       bool
+}
+
+type ServerOption func(*Server)
+
+// WithWorkers sets how many requests are handled at once.
+func WithWorkers(n int) ServerOption {
+	return func(s *Server) {
+		s.workers = n
+	}
+}
+
+// WithQueueSize sets how many requests may wait for a worker before new ones
+// are rejected as busy.
+func WithQueueSize(n int) ServerOption {
+	return func(s *Server) {
+		s.queueSize = n
+	}
+}
+
+// WithMaxMessageSize sets the size above which requests are refused and
+// replies are replaced by a CodeTooLarge error.
+func WithMaxMessageSize(n int) ServerOption {
+	return func(s *Server) {
+		s.maxMessageSize = n
+	}
+}
+
+// WithNetwork makes the server listen for datagrams on nw instead of a real
+// UDP socket. WithTCP has no effect on such a server.
+func WithNetwork(nw Network) ServerOption {
+	return func(s *Server) {
+		s.network = nw
+	}
+}
+
+// WithTCP makes the server accept TCP connections on its port in addition to
+// UDP datagrams.
+func WithTCP() ServerOption {
+	return func(s *Server) {
+		s.tcp = true
+	}
+}
+
+type request struct {
+	seq  uint64
+	data []byte
+	from peer
+}
+
+// service is a receiver registered under a name, together with the methods
+// that can be called on it.
+type service struct {
+	receiver reflect.Value
+	methods  map[string]*ServiceMethod
 }
 
 type ServiceMethod struct {
@@ -23,93 +116,482 @@ type ServiceMethod struct {
 	ReplyType reflect.Type
 }
 
-func NewServer(host string, port int) (*Server, error) {
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, port))
-	if err != nil {
-		return nil, err
+func NewServer(host string, port int, opts ...ServerOption) (*Server, error) {
+	s := &Server{
+		host:           host,
+		services:       make(map[string]*service),
+		workers:        DefaultWorkers,
+		queueSize:      DefaultQueueSize,
+		maxMessageSize: DefaultMaxMessageSize,
+		network:        UDPNetwork,
+		done:           make(chan struct{}),
+		tcpConns:       make(map[*tcpTransport]bool),
+		nonces:         newNonceCache(DefaultMaxNonces),
 	}
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.workers < 1 {
+		s.workers = 1
+	}
+	if s.queueSize < 0 {
+		s.queueSize = 0
+	}
+	if s.encrypt {
+		if s.key == nil {
+			return nil, errors.New("bsonrpc: encryption requires a signing key")
+		}
+		s.sessions = newSessionCache(DefaultMaxSessions, DefaultMaxSessionsPerKey, DefaultSessionTimeout)
+	}
+	s.queue = make(chan request, s.queueSize)
+	if err := s.bind(port); err != nil {
 		return nil, err
 	}
-	return &Server{
-		host:           host,
-		port:           port,
-		conn:           conn,
-		serviceMethods: make(map[string]*ServiceMethod),
-	}, nil
+	return s, nil
+}
+
+// bind opens the UDP socket and, if enabled, the TCP listener on the same
+// port. When port is 0, a new port is tried if the one picked for UDP turns
+// out to be taken for TCP.
+func (s *Server) bind(port int) error {
+	for attempt := 0; ; attempt++ {
+		conn, err := s.network.ListenPacket(s.host, port)
+		if err != nil {
+			return err
+		}
+		bound, err := portOf(conn.LocalAddr())
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		if !s.tcp || s.network != UDPNetwork {
+			s.conn, s.port = conn, bound
+			return nil
+		}
+		ln, err := net.Listen(TCP, net.JoinHostPort(s.host, strconv.Itoa(bound)))
+		if err == nil {
+			s.conn, s.tcpListener, s.port = conn, ln, bound
+			return nil
+		}
+		conn.Close()
+		if port != 0 || attempt == 10 {
+			return err
+		}
+	}
+}
+
+// Port returns the port the server is bound to, which differs from the one
+// passed to NewServer when that was 0.
+func (s *Server) Port() int {
+	return s.port
 }
 
+// Networks returns the networks the server accepts requests on.
+func (s *Server) Networks() []string {
+	if s.tcpListener != nil {
+		return []string{UDP, TCP}
+	}
+	return []string{UDP}
+}
+
+// Listen reads requests and hands them to the worker pool until Shutdown is
+// called.
 func (s *Server) Listen() {
+	s.m.Lock()
+	if s.listening || s.shutdown {
+		s.m.Unlock()
+		return
+	}
+	s.listening = true
+	s.m.Unlock()
+
 	fmt.Println("Listening on " + s.host + ":" + strconv.Itoa(s.port))
+	for i := 0; i < s.workers; i++ {
+		s.wg.Add(1)
+		go s.worker()
+	}
+	s.readers.Add(1)
+	go s.serveUDP()
+	if s.tcpListener != nil {
+		s.readers.Add(1)
+		go s.acceptTCP()
+	}
+	s.readers.Wait()
+	close(s.queue)
+	close(s.done)
+}
+
+func (s *Server) serveUDP() {
+	defer s.readers.Done()
+	fragments := newReassembler(s.maxMessageSize)
+	buf := make([]byte, 64<<10)
 	for {
-		reqBytes, sender, err := s.readRequest()
+		n, sender, err := s.conn.ReadFrom(buf)
 		if err != nil {
+			if s.isShutdown() || errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Println("Error reading request: " + err.Error())
 			continue
 		}
-		reqObj, err := s.unmarshalRequest(reqBytes)
+		from := udpPeer{conn: s.conn, addr: sender, maxSize: s.maxMessageSize}
+		seq, reqBytes, err := fragments.add(sender.String(), buf[:n])
+		if errors.Is(err, ErrMessageTooLarge) {
+			s.refuseTooLarge(seq, from)
+			continue
+		}
 		if err != nil {
-			log.Println("Error parsing request: " + err.Error())
+			log.Println("Error reading request: " + err.Error())
+			continue
+		}
+		if reqBytes == nil {
 			continue
 		}
-		replyBytes, err := s.handleRequest(reqObj)
+		s.enqueue(request{seq: seq, data: reqBytes, from: from})
+	}
+}
+
+func (s *Server) acceptTCP() {
+	defer s.readers.Done()
+	for {
+		conn, err := s.tcpListener.Accept()
 		if err != nil {
-			log.Println("Error handling request: " + err.Error())
+			if s.isShutdown() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println("Error accepting connection: " + err.Error())
+			continue
+		}
+		t := newTCPTransport(conn, s.maxMessageSize)
+		s.m.Lock()
+		if s.shutdown {
+			s.m.Unlock()
+			conn.Close()
+			return
+		}
+		s.tcpConns[t] = true
+		s.readers.Add(1)
+		s.m.Unlock()
+		go s.serveTCP(t)
+	}
+}
+
+// serveTCP reads requests from one connection until the client hangs up or
+// the server shuts down. In the latter case the connection is left open for
+// the replies still to be sent and closed by Shutdown.
+func (s *Server) serveTCP(t *tcpTransport) {
+	defer s.readers.Done()
+	for {
+		seq, reqBytes, err := t.recv()
+		if errors.Is(err, ErrMessageTooLarge) {
+			s.refuseTooLarge(seq, t)
 			continue
 		}
-		sendErr := s.sendResponse(replyBytes, sender)
-		if sendErr != nil {
-			log.Println("Error sending response: " + sendErr.Error())
+		if err != nil {
+			s.m.Lock()
+			if !s.shutdown {
+				delete(s.tcpConns, t)
+				t.Close()
+			}
+			s.m.Unlock()
+			return
 		}
+		s.enqueue(request{seq: seq, data: reqBytes, from: t})
+	}
+}
+
+func (s *Server) enqueue(req request) {
+	select {
+	case s.queue <- req:
+	default:
+		s.reject(req)
 	}
 }
 
-func (s *Server) readRequest() ([]byte, *net.UDPAddr, error) {
-	buf := make([]byte, 1024)
-	n, sender, err := s.conn.ReadFromUDP(buf)
+// Shutdown stops reading new requests, waits for the queued and running ones
+// to be answered, then closes the connections. If ctx ends first, the
+// connections are closed without waiting any longer and ctx's error returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.m.Lock()
+	if s.shutdown {
+		s.m.Unlock()
+		return nil
+	}
+	s.shutdown = true
+	listening := s.listening
+	for t := range s.tcpConns {
+		t.conn.SetReadDeadline(time.Now())
+	}
+	s.m.Unlock()
+
+	var err error
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+	if listening {
+		s.conn.SetReadDeadline(time.Now())
+		drained := make(chan struct{})
+		go func() {
+			<-s.done
+			s.wg.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	s.m.Lock()
+	for t := range s.tcpConns {
+		t.Close()
+		delete(s.tcpConns, t)
+	}
+	s.m.Unlock()
+	if closeErr := s.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *Server) isShutdown() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.shutdown
+}
+
+func (s *Server) worker() {
+	defer s.wg.Done()
+	for req := range s.queue {
+		if reply, sess, signed, ok := s.serveRequest(req); ok {
+			s.respond(req.seq, reply, sess, signed, req.from)
+		}
+	}
+}
+
+// reject answers a request that found the queue full with a CodeBusy error.
+func (s *Server) reject(req request) {
+	s.respond(req.seq, Reply{
+		Seq:   req.seq,
+		Error: Error{Code: CodeBusy, Message: "server busy"},
+	}, nil, SignedMessage{}, req.from)
+}
+
+func (s *Server) refuseTooLarge(seq uint64, to peer) {
+	s.respond(seq, Reply{
+		Seq:   seq,
+		Error: Error{Code: CodeTooLarge, Message: fmt.Sprintf("requests are limited to %d bytes", s.maxMessageSize)},
+	}, nil, SignedMessage{}, to)
+}
+
+// respond sends reply, a Reply or BatchReply, for the request numbered seq,
+// encrypted for sess if the request came through a session and otherwise
+// addressed to the key that signed the request, if any, and carrying the
+// request's nonce. signed is the envelope of the request, empty for requests
+// that could not be opened.
+func (s *Server) respond(seq uint64, reply any, sess *session, signed SignedMessage, to peer) {
+	replyBytes, err := s.encodeReply(reply, sess, signed)
 	if err != nil {
-		return nil, nil, err
+		log.Println("Error encoding reply: " + err.Error())
+		replyBytes, err = s.encodeReply(Reply{
+			Seq:   seq,
+			Error: Error{Code: CodeInternal, Message: err.Error()},
+		}, sess, signed)
+		if err != nil {
+			return
+		}
+	}
+	sendErr := to.send(seq, replyBytes)
+	if errors.Is(sendErr, ErrMessageTooLarge) {
+		replyBytes, _ = s.encodeReply(Reply{
+			Seq:   seq,
+			Error: Error{Code: CodeTooLarge, Message: fmt.Sprintf("reply of %d bytes exceeds the limit of %d", len(replyBytes), s.maxMessageSize)},
+		}, sess, signed)
+		sendErr = to.send(seq, replyBytes)
+	}
+	if sendErr != nil {
+		log.Println("Error sending response to " + to.String() + ": " + sendErr.Error())
 	}
-	return buf[:n], sender, err
 }
 
-func (s *Server) unmarshalRequest(req []byte) (*Call, error) {
-	var c Call
-	err := bson.Unmarshal(req, &c)
+// encodeReply encodes reply and encrypts it for sess or, if sess is nil,
+// signs it as the answer to the signed request if the server has a signing
+// key.
+func (s *Server) encodeReply(reply any, sess *session, signed SignedMessage) ([]byte, error) {
+	replyBytes, err := bson.Marshal(reply)
 	if err != nil {
 		return nil, err
 	}
-	return &c, nil
+	if sess != nil {
+		return sess.seal(replyBytes)
+	}
+	data, _, err := seal(s.key, replyContext, signed.Key, signed.Nonce, replyBytes)
+	return data, err
 }
 
-func (s *Server) handleRequest(request *Call) ([]byte, error) {
-
-	serviceMethod, ok := s.serviceMethods[request.Method]
-	if !ok {
-		return nil, fmt.Errorf("no such method: " + request.Method)
+// serveRequest decodes and runs a request, returning the Reply or
+// BatchReply to send back, the session to encrypt it for, the envelope of
+// the request and whether to send it, which is not the case for
+// notifications. Requests that cannot be decoded, name an unknown method or
+// whose handler fails are answered with an Error, as are signed requests
+// whose signature does not verify or that are replayed and, on an
+// encrypting server, requests sent in the clear.
+func (s *Server) serveRequest(req request) (any, *session, SignedMessage, bool) {
+	signed, sess, err := s.openRequest(req.data)
+	signer := ed25519.PublicKey(signed.Key)
+	var doc *bson.RawD
+	if err == nil {
+		doc, err = readRequest(signed.Payload)
+	}
+	encrypted := sess != nil || !s.encrypt
+	if err == nil {
+		if calls, ok := doc.Pairs["Calls"]; ok && encrypted {
+			return s.serveBatch(req.seq, calls, signer, req.from), sess, signed, true
+		} else if ok {
+			err = ErrUnencrypted
+		}
+	}
+	var call incomingCall
+	if err == nil {
+		call, err = decodeCall(doc)
+		call.signer = signer
+	}
+	if err == nil && !encrypted && call.method != handshakeMethod {
+		err = ErrUnencrypted
+	}
+	if err != nil {
+		log.Println("Error parsing request: " + err.Error())
+		rpcErr, ok := err.(*Error)
+		if !ok {
+			rpcErr = &Error{Code: CodeInvalidRequest, Message: err.Error()}
+		}
+		return Reply{Seq: req.seq, Error: *rpcErr}, sess, signed, true
 	}
+	return s.serveCall(call, req.from), sess, signed, !call.notify
+}
 
-	reply := reflect.New(serviceMethod.ReplyType.Elem())
-	err := s.call(*serviceMethod, request.Args, reply)
+// serveCall runs a decoded call and returns its Reply.
+func (s *Server) serveCall(call incomingCall, from peer) Reply {
+	result, err := s.handleRequest(call, from)
 	if err != nil {
-		return nil, err
+		if call.notify {
+			log.Printf("Notification %s from %s failed: %s", call.method, from, err)
+		}
+		rpcErr, ok := err.(*Error)
+		if !ok {
+			rpcErr = &Error{Code: CodeHandler, Message: err.Error()}
+		}
+		return Reply{Seq: call.seq, Error: *rpcErr}
 	}
+	return Reply{Seq: call.seq, Result: result}
+}
 
-	replyBytes, err := bson.Marshal(reply.Elem().Interface())
+// readRequest reads the top level of an encoded Call or BatchRequest.
+func readRequest(data []byte) (*bson.RawD, error) {
+	return bson.NewReader(data).ReadDocument()
+}
+
+// incomingCall is a Call whose arguments are still encoded, waiting to be
+// decoded into the argument type of the method it names.
+type incomingCall struct {
+	seq    uint64
+	method string
+	args   *bson.Raw
+	notify bool
+	signer ed25519.PublicKey
+}
+
+// decodeCall reads the envelope of a Call without decoding its Args, so that
+// they can be decoded straight into the handler's declared type instead of
+// relying on types registered by an earlier Marshal in this process.
+func decodeCall(doc *bson.RawD) (call incomingCall, err error) {
+	call.seq, err = readSeq(doc)
 	if err != nil {
-		return nil, err
+		return incomingCall{}, err
+	}
+	rawMethod, ok := doc.Pairs["Method"]
+	if !ok || rawMethod.Type != bson.String {
+		return incomingCall{}, errors.New("request has no method")
+	}
+	if err := rawMethod.Unmarshal(&call.method); err != nil {
+		return incomingCall{}, err
+	}
+	call.args = doc.Pairs["Args"]
+	if rawNotify, ok := doc.Pairs["Notify"]; ok && rawNotify.Type == bson.Bool {
+		if err := rawNotify.Unmarshal(&call.notify); err != nil {
+			return incomingCall{}, err
+		}
 	}
+	return call, nil
+}
 
-	return replyBytes, nil
+// decodeArgs decodes raw into a new value of argType.
+func decodeArgs(raw *bson.Raw, argType reflect.Type) (reflect.Value, error) {
+	if raw == nil || raw.Type != bson.Object {
+		return reflect.Value{}, errors.New("arguments are not a document")
+	}
+	structType := argType
+	if argType.Kind() == reflect.Ptr {
+		structType = argType.Elem()
+	}
+	ptr := reflect.New(structType)
+	if err := bson.Unmarshal(raw.Data, ptr.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	if argType.Kind() == reflect.Ptr {
+		return ptr, nil
+	}
+	return ptr.Elem(), nil
 }
 
-func (s *Server) sendResponse(response []byte, sender *net.UDPAddr) error {
-	_, err := s.conn.WriteToUDP(response, sender)
+func (s *Server) handleRequest(request incomingCall, from peer) (any, error) {
+	if request.method == handshakeMethod && s.encrypt {
+		return s.acceptHandshake(request.args)
+	}
+	svc, serviceMethod, ok := s.lookupMethod(request.method)
+	if !ok {
+		return nil, &Error{Code: CodeMethodNotFound, Message: request.method}
+	}
+	args, err := decodeArgs(request.args, serviceMethod.ArgType)
 	if err != nil {
-		return err
+		return nil, &Error{
+			Code:    CodeInvalidRequest,
+			Message: fmt.Sprintf("%s expects %s: %s", request.method, serviceMethod.ArgType, err),
+		}
 	}
-	return nil
+
+	handler := Handler(func(args any) (any, error) {
+		if args == nil || reflect.TypeOf(args) != serviceMethod.ArgType {
+			return nil, &Error{
+				Code:    CodeInvalidRequest,
+				Message: fmt.Sprintf("%s expects %s, got %T", request.method, serviceMethod.ArgType, args),
+			}
+		}
+		reply := reflect.New(serviceMethod.ReplyType.Elem())
+		if err := svc.call(*serviceMethod, reflect.ValueOf(args), reply); err != nil {
+			return nil, err
+		}
+		return reply.Elem().Interface(), nil
+	})
+	info := RequestInfo{
+		Method: request.method,
+		Peer:   from.String(),
+		Notify: request.notify,
+		Signer: request.signer,
+	}
+	handler = recoverHandler(request.method, chainHandler(s.interceptors, info, handler))
+	return handler(args.Interface())
+}
+
+// isStructArg reports whether t, the argument type of a method, is a struct
+// or a pointer to one, which is what the arguments document of a call is
+// decoded into.
+func isStructArg(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
 }
 
 func isValidMethod(serviceType reflect.Type, method reflect.Method) bool {
@@ -120,35 +602,80 @@ func isValidMethod(serviceType reflect.Type, method reflect.Method) bool {
 		method.Type.Out(0) == reflect.TypeOf((*error)(nil)).Elem()
 }
 
+// lookupMethod finds the service and method named by a "Service.Method"
+// string.
+func (s *Server) lookupMethod(name string) (*service, *ServiceMethod, bool) {
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 {
+		return nil, nil, false
+	}
+	s.m.Lock()
+	svc, ok := s.services[name[:dot]]
+	s.m.Unlock()
+	if !ok {
+		return nil, nil, false
+	}
+	method, ok := svc.methods[name[dot+1:]]
+	return svc, method, ok
+}
+
+// Register publishes the methods of receiver under the name of its type, so
+// that a method M of a *T is called as "T.M". It fails if a method has the
+// signature of one but its arguments are not a struct or a pointer to one.
 func (s *Server) Register(receiver any) error {
 	t := reflect.TypeOf(receiver)
-	if t.Kind() != reflect.Ptr {
+	if t == nil || t.Kind() != reflect.Ptr {
+		return fmt.Errorf("receiver must be a pointer to struct")
+	}
+	return s.RegisterName(t.Elem().Name(), receiver)
+}
+
+// RegisterName publishes the methods of receiver under name instead of the
+// name of its type. Several services can be registered on one server as long
+// as their names differ.
+func (s *Server) RegisterName(name string, receiver any) error {
+	t := reflect.TypeOf(receiver)
+	if t == nil || t.Kind() != reflect.Ptr {
 		return fmt.Errorf("receiver must be a pointer to struct")
 	}
 	if t.Elem().Kind() != reflect.Struct {
 		return fmt.Errorf("receiver must be a struct")
 	}
-	s.service = reflect.ValueOf(receiver)
+	if name == "" || strings.Contains(name, ".") {
+		return fmt.Errorf("invalid service name %q", name)
+	}
+	svc := &service{
+		receiver: reflect.ValueOf(receiver),
+		methods:  make(map[string]*ServiceMethod),
+	}
 	for i := 0; i < t.NumMethod(); i++ {
 		method := t.Method(i)
-		methodKey := t.Elem().Name() + "." + method.Name
-		_, exists := s.serviceMethods[methodKey]
-		if !exists && isValidMethod(s.service.Type(), method) {
-			s.serviceMethods[methodKey] = &ServiceMethod{
+		if isValidMethod(t, method) {
+			if !isStructArg(method.Type.In(1)) {
+				return fmt.Errorf("method %s.%s takes %s, arguments must be a struct", name, method.Name, method.Type.In(1))
+			}
+			svc.methods[method.Name] = &ServiceMethod{
 				Method:    method,
 				ArgType:   method.Type.In(1),
 				ReplyType: method.Type.In(2),
 			}
 		}
 	}
-	if len(s.serviceMethods) == 0 {
-		log.Println("Warning: no methods were registered")
+	if len(svc.methods) == 0 {
+		log.Printf("Warning: service %s has no methods to register", name)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, exists := s.services[name]; exists {
+		return fmt.Errorf("service %s is already registered", name)
 	}
+	s.services[name] = svc
 	return nil
 }
 
-func (s *Server) call(serviceMethod ServiceMethod, args any, reply reflect.Value) error {
-	fnArgs := []reflect.Value{s.service, reflect.ValueOf(args), reply}
+func (svc *service) call(serviceMethod ServiceMethod, args reflect.Value, reply reflect.Value) error {
+	fnArgs := []reflect.Value{svc.receiver, args, reply}
 	errVal := serviceMethod.Method.Func.Call(fnArgs)[0].Interface()
 	if errVal != nil {
 		return errVal.(error)
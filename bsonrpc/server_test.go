@@ -0,0 +1,901 @@
+package bsonrpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-dht/bson"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func dialEcho(t *testing.T, s *Server) *Client {
+	c, err := Dial("127.0.0.1", s.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func echoService(s *Server) *Echo {
+	return s.services["Echo"].receiver.Interface().(*Echo)
+}
+
+func TestServer_SlowHandlerDoesNotBlockOthers(t *testing.T) {
+	s := newEchoServer(t, WithWorkers(2))
+	c := dialEcho(t, s)
+	echo := echoService(s)
+
+	blocked := make(chan error, 1)
+	go func() {
+		var reply EchoReply
+		blocked <- c.Call("Echo.Block", EchoArgs{N: 1}, &reply)
+	}()
+
+	var reply EchoReply
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.CallContext(ctx, "Echo.Echo", EchoArgs{N: 2}, &reply); err != nil || reply.N != 2 {
+		t.Errorf("A free worker should answer while another is blocked, got %v (%v)", reply, err)
+	}
+	close(echo.release)
+	if err := <-blocked; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServer_RejectsWhenQueueIsFull(t *testing.T) {
+	s := newEchoServer(t, WithWorkers(1), WithQueueSize(1))
+	c := dialEcho(t, s)
+	echo := echoService(s)
+	defer close(echo.release)
+
+	// One call occupies the worker and one waits in the queue; the rest of
+	// the calls should be turned away straight away.
+	var wg sync.WaitGroup
+	busy := make(chan struct{}, 8)
+	for i := int64(0); i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			var reply EchoReply
+			var rpcErr *Error
+			err := c.CallContext(ctx, "Echo.Block", EchoArgs{N: i}, &reply)
+			if errors.As(err, &rpcErr) && rpcErr.Code == CodeBusy {
+				busy <- struct{}{}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(busy) < 6 {
+		t.Errorf("Calls beyond the worker and queue should be rejected as busy, got %d of 8", len(busy))
+	}
+}
+
+func TestServer_ShutdownDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	shutdownDone := make(chan struct{})
+	drainedFirst := make(chan bool, 1)
+	s := newEchoServer(t, WithWorkers(1), WithInterceptors(func(info RequestInfo, args any, next Handler) (any, error) {
+		if info.Method != "Echo.Block" {
+			return next(args)
+		}
+		close(started)
+		reply, err := next(args)
+		select {
+		case <-shutdownDone:
+			drainedFirst <- false
+		default:
+			drainedFirst <- true
+		}
+		return reply, err
+	}))
+	c := dialEcho(t, s)
+	echo := echoService(s)
+
+	result := make(chan error, 1)
+	go func() {
+		var reply EchoReply
+		result <- c.Call("Echo.Block", EchoArgs{N: 1}, &reply)
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		err := s.Shutdown(context.Background())
+		close(shutdownDone)
+		shutdown <- err
+	}()
+	for {
+		s.m.Lock()
+		stopping := s.shutdown
+		s.m.Unlock()
+		if stopping {
+			break
+		}
+		runtime.Gosched()
+	}
+	close(echo.release)
+	if !<-drainedFirst {
+		t.Errorf("Shutdown should wait for the running request")
+	}
+	if err := <-result; err != nil {
+		t.Errorf("The running request should still be answered: %s", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+
+	var reply EchoReply
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.CallContext(ctx, "Echo.Echo", EchoArgs{N: 2}, &reply); err == nil {
+		t.Errorf("A server that has shut down should not answer")
+	}
+}
+
+func (e *Echo) Repeat(args EchoArgs, reply *EchoBytes) error {
+	reply.Data = bytes.Repeat([]byte{'x'}, int(args.N))
+	return nil
+}
+
+type EchoBytes struct {
+	Data []byte
+}
+
+func (e *Echo) Bytes(args EchoBytes, reply *EchoBytes) error {
+	reply.Data = args.Data
+	return nil
+}
+
+func TestServer_LargeMessages(t *testing.T) {
+	s := newEchoServer(t, WithMaxMessageSize(32<<10))
+	c := dialEcho(t, s)
+
+	var reply EchoBytes
+	if err := c.Call("Echo.Repeat", EchoArgs{N: 20 << 10}, &reply); err != nil || len(reply.Data) != 20<<10 {
+		t.Errorf("A reply spanning many datagrams should be reassembled, got %d bytes (%v)", len(reply.Data), err)
+	}
+	if err := c.Call("Echo.Repeat", EchoArgs{N: 40 << 10}, &reply); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("A reply over the server's limit should fail with ErrMessageTooLarge, got %v", err)
+	}
+
+	var echoed EchoBytes
+	big := EchoBytes{Data: bytes.Repeat([]byte{'y'}, 40<<10)}
+	if err := c.Call("Echo.Bytes", big, &echoed); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("A request over the server's limit should fail with ErrMessageTooLarge, got %v", err)
+	}
+
+	small, err := Dial("127.0.0.1", s.Port(), WithClientMaxMessageSize(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small.Close()
+	if err := small.Call("Echo.Bytes", EchoBytes{Data: make([]byte, 2048)}, &echoed); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("A request over the client's limit should not be sent, got %v", err)
+	}
+	if err := small.Call("Echo.Repeat", EchoArgs{N: 2048}, &reply); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("A reply over the client's limit should fail with ErrMessageTooLarge, got %v", err)
+	}
+}
+
+func TestReassembler_RejectsInconsistentHeaders(t *testing.T) {
+	r := newReassembler(DefaultMaxMessageSize)
+	header := func(size, index, count int) []byte {
+		d := make([]byte, fragmentHeaderSize)
+		binary.LittleEndian.PutUint64(d[0:8], 1)
+		binary.LittleEndian.PutUint32(d[8:12], uint32(size))
+		binary.LittleEndian.PutUint16(d[12:14], uint16(index))
+		binary.LittleEndian.PutUint16(d[14:16], uint16(count))
+		return d
+	}
+	for _, d := range [][]byte{
+		header(0, 1, 0xffff),
+		header(2*maxFragmentPayload, 0, 0xffff),
+		header(2*maxFragmentPayload, 0, 3),
+		header(2*maxFragmentPayload, 0, 2),
+		append(header(3, 0, 1), 'x'),
+	} {
+		if _, _, err := r.add("sender", d); err == nil {
+			t.Errorf("A fragment of %d bytes with header %x should be refused", len(d), d)
+		}
+	}
+	if len(r.partial) != 0 {
+		t.Errorf("Refused fragments should not be buffered, %d partial messages are", len(r.partial))
+	}
+
+	data := bytes.Repeat([]byte{'z'}, 2*maxFragmentPayload+1)
+	datagrams, err := fragment(2, data, DefaultMaxMessageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for _, d := range datagrams {
+		if _, got, err = r.add("sender", d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Fragments of a message should be reassembled, got %d bytes", len(got))
+	}
+}
+
+func TestServer_TCP(t *testing.T) {
+	s := newEchoServer(t, WithTCP())
+	if networks := s.Networks(); len(networks) != 2 || networks[1] != TCP {
+		t.Fatalf("A server created with WithTCP should listen on UDP and TCP, got %v", networks)
+	}
+
+	pool := NewPool()
+	defer pool.Close()
+	c, err := pool.Get(TCP, "127.0.0.1", s.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := pool.Get(TCP, "127.0.0.1", s.Port()); again != c {
+		t.Errorf("The pool should reuse the connection to the same server")
+	}
+
+	var wg sync.WaitGroup
+	for i := int64(0); i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply EchoBytes
+			if err := c.Call("Echo.Repeat", EchoArgs{N: 100<<10 + i}, &reply); err != nil || len(reply.Data) != int(100<<10+i) {
+				t.Errorf("Calls sharing a TCP connection should get their own reply, got %d bytes (%v)", len(reply.Data), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	udp := dialEcho(t, s)
+	var reply EchoReply
+	if err := udp.Call("Echo.Echo", EchoArgs{N: 3}, &reply); err != nil || reply.N != 3 {
+		t.Errorf("The server should still answer on UDP, got %v (%v)", reply, err)
+	}
+}
+
+func TestPool_CloseIdle(t *testing.T) {
+	s := newEchoServer(t)
+	pool := NewPool()
+	defer pool.Close()
+
+	c, err := pool.Get(UDP, "127.0.0.1", s.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed := pool.CloseIdle(time.Minute); removed != 0 || pool.Len() != 1 {
+		t.Errorf("Recently used clients should stay pooled")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if removed := pool.CloseIdle(time.Millisecond); removed != 1 || pool.Len() != 0 {
+		t.Errorf("Idle clients should be closed and removed, %d removed", removed)
+	}
+	var reply EchoReply
+	if err := c.Call("Echo.Echo", EchoArgs{N: 1}, &reply); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("An evicted client should be closed, got %v", err)
+	}
+
+	c, err = pool.Get(UDP, "127.0.0.1", s.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call("Echo.Echo", EchoArgs{N: 2}, &reply); err != nil || reply.N != 2 {
+		t.Errorf("The pool should dial a new client after eviction, got %v (%v)", reply, err)
+	}
+}
+
+func TestPool_CloseIdleKeepsClientsWithCallsInFlight(t *testing.T) {
+	s := newEchoServer(t)
+	pool := NewPool()
+	defer pool.Close()
+
+	c, err := pool.Get(UDP, "127.0.0.1", s.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		var reply EchoReply
+		done <- c.Call("Echo.Block", EchoArgs{N: 1}, &reply)
+	}()
+	for {
+		if _, idle := c.idleSince(); !idle {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if removed := pool.CloseIdle(time.Millisecond); removed != 0 || pool.Len() != 1 {
+		t.Errorf("Clients with a call in flight should stay pooled, %d removed", removed)
+	}
+
+	released := time.Now()
+	close(echoService(s).release)
+	if err := <-done; err != nil {
+		t.Fatalf("The call in flight should complete: %s", err)
+	}
+	if since, idle := c.idleSince(); !idle || since.Before(released) {
+		t.Errorf("A client should count as used until its last call completes, idle since %v", since)
+	}
+}
+
+// Counter is a second service whose methods must be dispatched to its own
+// receiver rather than to Echo.
+type Counter struct {
+	n int64
+}
+
+func (c *Counter) Add(args EchoArgs, reply *EchoReply) error {
+	c.n += args.N
+	reply.N = c.n
+	return nil
+}
+
+func TestServer_MultipleServices(t *testing.T) {
+	s := newEchoServer(t)
+	if err := s.Register(&Counter{n: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterName("Admin", &Counter{n: 100}); err != nil {
+		t.Fatal(err)
+	}
+	c := dialEcho(t, s)
+
+	var reply EchoReply
+	if err := c.Call("Echo.Echo", EchoArgs{N: 1}, &reply); err != nil || reply.N != 1 {
+		t.Errorf("Echo.Echo = %v (%v), want 1", reply, err)
+	}
+	if err := c.Call("Counter.Add", EchoArgs{N: 1}, &reply); err != nil || reply.N != 11 {
+		t.Errorf("Counter.Add = %v (%v), want 11", reply, err)
+	}
+	if err := c.Call("Admin.Add", EchoArgs{N: 1}, &reply); err != nil || reply.N != 101 {
+		t.Errorf("Admin.Add = %v (%v), want 101", reply, err)
+	}
+	var rpcErr *Error
+	if err := c.Call("Counter.Echo", EchoArgs{N: 1}, &reply); !errors.As(err, &rpcErr) || rpcErr.Code != CodeMethodNotFound {
+		t.Errorf("Methods of one service should not be callable on another, got %v", err)
+	}
+}
+
+// Scalar takes arguments that are not a document, which cannot be decoded.
+type Scalar struct{}
+
+func (Scalar) Double(n int, reply *int) error {
+	*reply = 2 * n
+	return nil
+}
+
+func TestServer_RegisterRejectsNonStructArguments(t *testing.T) {
+	s := newEchoServer(t)
+	if err := s.Register(&Scalar{}); err == nil {
+		t.Errorf("Methods whose arguments are not a struct should be rejected")
+	}
+}
+
+func TestServer_RegisterRejectsDuplicateNames(t *testing.T) {
+	s := newEchoServer(t)
+	if err := s.Register(&Echo{}); err == nil {
+		t.Errorf("Registering a second Echo should fail")
+	}
+	if err := s.RegisterName("Echo", &Counter{}); err == nil {
+		t.Errorf("Registering another receiver under a taken name should fail")
+	}
+	if err := s.RegisterName("Bad.Name", &Counter{}); err == nil {
+		t.Errorf("Service names containing a dot should be rejected")
+	}
+}
+
+func TestServer_Interceptors(t *testing.T) {
+	var m sync.Mutex
+	var seen []string
+	record := func(name string) ServerInterceptor {
+		return func(info RequestInfo, args any, next Handler) (any, error) {
+			reply, err := next(args)
+			m.Lock()
+			seen = append(seen, fmt.Sprintf("%s %s %v %v %v", name, info.Method, args, reply, err))
+			m.Unlock()
+			return reply, err
+		}
+	}
+	double := func(info RequestInfo, args any, next Handler) (any, error) {
+		return next(EchoArgs{N: args.(EchoArgs).N * 2})
+	}
+	s := newEchoServer(t, WithInterceptors(record("outer"), double, record("inner")))
+	c := dialEcho(t, s)
+
+	var reply EchoReply
+	if err := c.Call("Echo.Echo", EchoArgs{N: 2}, &reply); err != nil || reply.N != 4 {
+		t.Errorf("Interceptors should be able to replace the arguments, got %v (%v)", reply, err)
+	}
+	want := []string{
+		"inner Echo.Echo {4} {4} <nil>",
+		"outer Echo.Echo {2} {4} <nil>",
+	}
+	m.Lock()
+	defer m.Unlock()
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("Interceptors saw %q, want %q", seen, want)
+	}
+}
+
+func TestServer_RecoversFromPanickingHandlers(t *testing.T) {
+	s := newEchoServer(t, WithWorkers(1), WithInterceptors(func(info RequestInfo, args any, next Handler) (any, error) {
+		if args.(EchoArgs).N < 0 {
+			panic("negative")
+		}
+		return next(args)
+	}))
+	c := dialEcho(t, s)
+
+	var reply EchoReply
+	var rpcErr *Error
+	if err := c.Call("Echo.Panic", EchoArgs{N: 1}, &reply); !errors.As(err, &rpcErr) || rpcErr.Code != CodeHandler {
+		t.Errorf("A panicking handler should fail the call, got %v", err)
+	}
+	if err := c.Call("Echo.Echo", EchoArgs{N: -1}, &reply); !errors.As(err, &rpcErr) || rpcErr.Code != CodeHandler {
+		t.Errorf("A panicking interceptor should fail the call, got %v", err)
+	}
+	if err := c.Call("Echo.Echo", EchoArgs{N: 2}, &reply); err != nil || reply.N != 2 {
+		t.Errorf("The server should keep serving after a panic, got %v (%v)", reply, err)
+	}
+}
+
+func TestServer_RejectsArgumentsOfTheWrongType(t *testing.T) {
+	s := newEchoServer(t, WithInterceptors(func(info RequestInfo, args any, next Handler) (any, error) {
+		return next(EchoReply{N: args.(EchoArgs).N})
+	}))
+	c := dialEcho(t, s)
+
+	var reply EchoReply
+	var rpcErr *Error
+	if err := c.Call("Echo.Echo", EchoArgs{N: 1}, &reply); !errors.As(err, &rpcErr) || rpcErr.Code != CodeInvalidRequest {
+		t.Errorf("Arguments an interceptor replaced with another type should be rejected, got %v", err)
+	}
+}
+
+func TestClient_Interceptors(t *testing.T) {
+	s := newEchoServer(t)
+	var info RequestInfo
+	c, err := Dial("127.0.0.1", s.Port(), WithClientInterceptors(func(ctx context.Context, i RequestInfo, args, reply any, next Invoker) error {
+		info = i
+		if args.(EchoArgs).N < 0 {
+			return errors.New("rejected")
+		}
+		return next(ctx, i, args, reply)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var reply EchoReply
+	if err := c.Call("Echo.Echo", EchoArgs{N: 3}, &reply); err != nil || reply.N != 3 {
+		t.Errorf("Echo.Echo = %v (%v), want 3", reply, err)
+	}
+	if info.Method != "Echo.Echo" || info.Peer != fmt.Sprintf("127.0.0.1:%d", s.Port()) {
+		t.Errorf("The interceptor should see the method and server address, got %+v", info)
+	}
+	if err := c.Call("Echo.Echo", EchoArgs{N: -1}, &reply); err == nil || err.Error() != "rejected" {
+		t.Errorf("An interceptor should be able to fail a call without sending it, got %v", err)
+	}
+}
+
+func TestServer_SignedMessages(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(nil)
+	_, clientKey, _ := ed25519.GenerateKey(nil)
+	signers := make(chan ed25519.PublicKey, 1)
+	s := newEchoServer(t, WithSigningKey(serverKey), WithInterceptors(func(info RequestInfo, args any, next Handler) (any, error) {
+		signers <- info.Signer
+		return next(args)
+	}))
+	c, err := Dial("127.0.0.1", s.Port(), WithClientSigningKey(clientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	expect := func(want ed25519.PrivateKey) func(ed25519.PublicKey) error {
+		return func(key ed25519.PublicKey) error {
+			if !key.Equal(want.Public()) {
+				return errors.New("unexpected signer")
+			}
+			return nil
+		}
+	}
+	var reply EchoReply
+	ctx := WithSignerCheck(context.Background(), expect(serverKey))
+	if err := c.CallContext(ctx, "Echo.Echo", EchoArgs{N: 3}, &reply); err != nil || reply.N != 3 {
+		t.Errorf("Signed call = %v (%v), want 3", reply, err)
+	}
+	if signer := <-signers; !signer.Equal(clientKey.Public()) {
+		t.Errorf("Server saw signer %x, want the client's key", signer)
+	}
+	ctx = WithSignerCheck(context.Background(), expect(clientKey))
+	if err := c.CallContext(ctx, "Echo.Echo", EchoArgs{N: 3}, &reply); err == nil {
+		t.Errorf("A reply signed by another key should fail the signer check")
+	}
+	<-signers
+}
+
+func TestSignedMessages_RejectTampering(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	data, _, err := seal(key, requestContext, nil, nil, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := open(requestContext, data); err != nil || string(msg.Payload) != "payload" || !key.Public().(ed25519.PublicKey).Equal(ed25519.PublicKey(msg.Key)) {
+		t.Fatalf("open = %q, %x (%v)", msg.Payload, msg.Key, err)
+	}
+	if _, err := open(replyContext, data); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("A request should not verify as a reply, got %v", err)
+	}
+	tampered := bytes.Replace(data, []byte("payload"), []byte("poyload"), 1)
+	if _, err := open(requestContext, tampered); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("A tampered message should not verify, got %v", err)
+	}
+}
+
+func TestServer_RejectsReplayedSignedMessages(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(nil)
+	_, clientKey, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	s := newEchoServer(t, WithSigningKey(serverKey))
+
+	data, _, err := seal(clientKey, requestContext, serverKey.Public().(ed25519.PublicKey), nil, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, _, err := s.openRequest(data); err != nil || string(msg.Payload) != "payload" {
+		t.Fatalf("openRequest = %q (%v)", msg.Payload, err)
+	}
+	if _, _, err := s.openRequest(data); !errors.Is(err, ErrReplayed) {
+		t.Errorf("A request received twice should be refused, got %v", err)
+	}
+
+	data, _, err = seal(clientKey, requestContext, otherKey.Public().(ed25519.PublicKey), nil, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.openRequest(data); !errors.Is(err, ErrReplayed) {
+		t.Errorf("A request addressed to another server should be refused, got %v", err)
+	}
+
+	stale := SignedMessage{
+		Key:     clientKey.Public().(ed25519.PublicKey),
+		Time:    time.Now().Add(-2 * DefaultMaxClockSkew).UnixNano(),
+		Nonce:   make([]byte, nonceSize),
+		Payload: []byte("payload"),
+	}
+	stale.Signature = ed25519.Sign(clientKey, signedBytes(requestContext, stale))
+	data, err = bson.Marshal(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.openRequest(data); !errors.Is(err, ErrReplayed) {
+		t.Errorf("A request signed long ago should be refused, got %v", err)
+	}
+}
+
+func TestClient_RejectsRepliesToOtherRequests(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(nil)
+	_, clientKey, _ := ed25519.GenerateKey(nil)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Answer the first call properly, and every later one with the reply to
+	// the first, as someone who captured it would.
+	go func() {
+		var captured [][]byte
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if captured == nil {
+				_, payload, err := parseFragment(buf[:n])
+				if err != nil {
+					return
+				}
+				msg, err := open(requestContext, payload)
+				if err != nil {
+					return
+				}
+				m := bson.M{}
+				if err := bson.Unmarshal(msg.Payload, &m); err != nil {
+					return
+				}
+				seq, _ := m["Seq"].(int32)
+				args, _ := m["Args"].(bson.M)
+				data, _ := bson.Marshal(Reply{Seq: uint64(seq), Result: bson.M{"N": args["N"]}})
+				sealed, _, err := seal(serverKey, replyContext, msg.Key, msg.Nonce, data)
+				if err != nil {
+					return
+				}
+				captured, _ = fragment(uint64(seq), sealed, DefaultMaxMessageSize)
+			}
+			for _, d := range captured {
+				conn.WriteToUDP(d, from)
+			}
+		}
+	}()
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	ctx := WithSignerCheck(context.Background(), func(key ed25519.PublicKey) error {
+		if !key.Equal(serverKey.Public()) {
+			return errors.New("unexpected signer")
+		}
+		return nil
+	})
+	for i, want := range []error{nil, ErrReplayed} {
+		c, err := Dial("127.0.0.1", port, WithClientSigningKey(clientKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply EchoReply
+		if err := c.CallContext(ctx, "Echo.Echo", EchoArgs{N: 5}, &reply); !errors.Is(err, want) {
+			t.Errorf("Call %d from a new client got %v (%v), want %v", i, reply, err, want)
+		}
+		c.Close()
+	}
+}
+
+func TestNonceCache_ForgetsOldestWhenFull(t *testing.T) {
+	nc := newNonceCache(2)
+	now := time.Now()
+	ago := func(age time.Duration) int64 {
+		return now.Add(-age).UnixNano()
+	}
+	for i, age := range []time.Duration{3, 1, 2} {
+		if !nc.accept([]byte{byte(i)}, ago(age*time.Second), now) {
+			t.Fatalf("Nonce %d should be accepted", i)
+		}
+	}
+	if nc.accept([]byte{1}, ago(time.Second), now) {
+		t.Errorf("A nonce still remembered should be refused")
+	}
+	if nc.accept([]byte{3}, ago(4*time.Second), now) {
+		t.Errorf("Messages older than a forgotten nonce should be refused")
+	}
+}
+
+func newEncryptedPair(t *testing.T, opts ...ServerOption) (*Server, *Client, ed25519.PrivateKey, ed25519.PrivateKey) {
+	_, serverKey, _ := ed25519.GenerateKey(nil)
+	_, clientKey, _ := ed25519.GenerateKey(nil)
+	s := newEchoServer(t, append([]ServerOption{WithSigningKey(serverKey), WithEncryption()}, opts...)...)
+	c, err := Dial("127.0.0.1", s.Port(), WithClientSigningKey(clientKey), WithClientEncryption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return s, c, serverKey, clientKey
+}
+
+func TestClient_Encryption(t *testing.T) {
+	signers := make(chan ed25519.PublicKey, 10)
+	s, c, serverKey, clientKey := newEncryptedPair(t, WithInterceptors(func(info RequestInfo, args any, next Handler) (any, error) {
+		signers <- info.Signer
+		return next(args)
+	}))
+
+	ctx := WithSignerCheck(context.Background(), func(key ed25519.PublicKey) error {
+		if !key.Equal(serverKey.Public()) {
+			return errors.New("unexpected signer")
+		}
+		return nil
+	})
+	var wg sync.WaitGroup
+	for i := int64(0); i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply EchoReply
+			if err := c.CallContext(ctx, "Echo.Echo", EchoArgs{N: i}, &reply); err != nil || reply.N != i {
+				t.Errorf("Encrypted call = %v (%v), want %d", reply, err, i)
+			}
+		}()
+	}
+	wg.Wait()
+	s.sessions.m.Lock()
+	n := len(s.sessions.sessions)
+	s.sessions.m.Unlock()
+	if n != 1 {
+		t.Errorf("Calls from one client should share a session, the server has %d", n)
+	}
+	for i := 0; i < 5; i++ {
+		if signer := <-signers; !signer.Equal(clientKey.Public()) {
+			t.Errorf("Server saw signer %x, want the client's key", signer)
+		}
+	}
+
+	var batch Batch
+	batch.Add("Echo.Echo", EchoArgs{N: 7}, &EchoReply{})
+	if err := c.CallBatch(context.Background(), &batch); err != nil || batch.Calls[0].Reply.(*EchoReply).N != 7 {
+		t.Errorf("Encrypted batch failed: %v", err)
+	}
+	<-signers
+
+	plain := dialEcho(t, s)
+	var reply EchoReply
+	var rpcErr *Error
+	if err := plain.Call("Echo.Echo", EchoArgs{N: 1}, &reply); !errors.As(err, &rpcErr) || rpcErr.Code != CodeInvalidRequest {
+		t.Errorf("A request in the clear should be refused by an encrypting server, got %v", err)
+	}
+}
+
+func TestClient_EncryptionRenewsForgottenSessions(t *testing.T) {
+	s, c, _, _ := newEncryptedPair(t)
+
+	var reply EchoReply
+	if err := c.Call("Echo.Echo", EchoArgs{N: 1}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	first := c.currentSession()
+	s.sessions.m.Lock()
+	for _, sess := range s.sessions.sessions {
+		s.sessions.remove(sess)
+	}
+	s.sessions.m.Unlock()
+
+	if err := c.Call("Echo.Echo", EchoArgs{N: 2}, &reply); err != nil || reply.N != 2 {
+		t.Errorf("A call on a forgotten session should be retried on a new one, got %v (%v)", reply, err)
+	}
+	if c.currentSession() == first {
+		t.Errorf("The client should have set up a new session")
+	}
+}
+
+func TestServer_RefusesReplayedHandshakes(t *testing.T) {
+	s, _, serverKey, clientKey := newEncryptedPair(t)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	hello := func(recipient ed25519.PublicKey, signed time.Time) *bson.Raw {
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := Hello{
+			Key:       clientKey.Public().(ed25519.PublicKey),
+			Recipient: recipient,
+			Time:      signed.UnixNano(),
+			Ephemeral: ephemeral.PublicKey().Bytes(),
+		}
+		h.Signature = ed25519.Sign(clientKey, helloBytes(h))
+		data, err := bson.Marshal(Call{Method: handshakeMethod, Args: h})
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := bson.NewReader(data).ReadDocument()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return doc.Pairs["Args"]
+	}
+
+	fresh := hello(serverKey.Public().(ed25519.PublicKey), time.Now())
+	if _, err := s.acceptHandshake(fresh); err != nil {
+		t.Fatalf("A fresh handshake should be accepted, got %v", err)
+	}
+	if _, err := s.acceptHandshake(fresh); err == nil {
+		t.Errorf("A replayed handshake should be refused")
+	}
+	if _, err := s.acceptHandshake(hello(nil, time.Now().Add(-2*DefaultMaxClockSkew))); err == nil {
+		t.Errorf("A handshake signed long ago should be refused")
+	}
+	if _, err := s.acceptHandshake(hello(otherKey.Public().(ed25519.PublicKey), time.Now())); err == nil {
+		t.Errorf("A handshake addressed to another server should be refused")
+	}
+	if n := len(s.sessions.sessions); n != 0 {
+		t.Errorf("Sessions nobody has sent a message through should be pending, %d are established", n)
+	}
+}
+
+func addSession(sc *sessionCache, id, peer string) *session {
+	sess := &session{id: []byte(id), peer: ed25519.PublicKey(peer), lastUsed: time.Now()}
+	sc.add(sess)
+	return sess
+}
+
+func TestSessionCache_PendingSessionsDoNotEvictEstablishedOnes(t *testing.T) {
+	sc := newSessionCache(2, 10, time.Minute)
+	sc.establish(addSession(sc, "a", "alice"))
+	sc.establish(addSession(sc, "b", "bob"))
+	for _, id := range []string{"c", "d", "e"} {
+		addSession(sc, id, "mallory")
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, ok := sc.get([]byte(id)); !ok {
+			t.Errorf("Established session %s should not be evicted by pending ones", id)
+		}
+	}
+	if len(sc.pending) != 2 {
+		t.Errorf("There should be at most 2 pending sessions, got %d", len(sc.pending))
+	}
+}
+
+func TestSessionCache_LimitsSessionsPerKey(t *testing.T) {
+	sc := newSessionCache(10, 3, time.Minute)
+	sc.establish(addSession(sc, "a", "alice"))
+	sc.establish(addSession(sc, "b", "bob"))
+	for _, id := range []string{"c", "d", "e"} {
+		sc.establish(addSession(sc, id, "alice"))
+	}
+	if n := len(sc.byKey["alice"]); n != 3 {
+		t.Errorf("A key should hold at most 3 sessions, alice holds %d", n)
+	}
+	if _, ok := sc.get([]byte("a")); ok {
+		t.Errorf("A key's oldest session should make way for its new ones")
+	}
+	if _, ok := sc.get([]byte("b")); !ok {
+		t.Errorf("The sessions of other keys should be kept")
+	}
+}
+
+func TestSession_SealAndReplay(t *testing.T) {
+	secret, hash := []byte("shared secret"), []byte("transcript")
+	client, err := newSession([]byte("id"), nil, secret, hash, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newSession([]byte("id"), nil, secret, hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := client.seal([]byte("secret payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret payload")) {
+		t.Errorf("Sealed messages should not contain their payload")
+	}
+	msg, ok, err := readSealed(data)
+	if err != nil || !ok {
+		t.Fatalf("readSealed = %v (%v)", ok, err)
+	}
+	if payload, err := server.open(msg); err != nil || string(payload) != "secret payload" {
+		t.Errorf("open = %q (%v)", payload, err)
+	}
+	if _, err := server.open(msg); err == nil {
+		t.Errorf("A replayed message should be refused")
+	}
+	if _, err := client.open(msg); err == nil {
+		t.Errorf("A request should not open as a reply")
+	}
+	msg.Ciphertext[0] ^= 1
+	msg.Counter++
+	if _, err := server.open(msg); err == nil {
+		t.Errorf("A tampered message should be refused")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, c := range []struct {
+		counter uint64
+		want    bool
+	}{
+		{0, false}, {1, true}, {3, true}, {2, true}, {2, false},
+		{100, true}, {1100, true}, {77, true}, {76, false}, {77, false},
+		{1100, false}, {1101, true}, {77, false}, {5000, true}, {1101, false},
+	} {
+		if got := w.accept(c.counter); got != c.want {
+			t.Errorf("accept(%d) = %v, want %v", c.counter, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,598 @@
+package bsonrpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-dht/bson"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Encrypted sessions are set up with a handshake in the style of Noise: the
+// client and server exchange X25519 ephemeral keys, each signed with the
+// Ed25519 key that identifies its sender, and derive from their shared secret
+// one AES-GCM key per direction. Every request and reply is then sent as a
+// SealedMessage. Clients keep their session for all their calls, and servers
+// keep up to DefaultMaxSessions sessions until they go unused for
+// DefaultSessionTimeout, so the handshake is only repeated once the server
+// has forgotten the session.
+//
+// A server refuses a Hello signed outside DefaultMaxClockSkew, addressed to
+// another key or whose ephemeral key it has seen before, so handshakes
+// cannot be replayed. The session a handshake sets up stays pending until
+// the client sends its first message through it, and pending sessions only
+// ever push out other pending ones. No identity key holds more than
+// DefaultMaxSessionsPerKey sessions at once.
+
+// DefaultMaxSessions, DefaultMaxSessionsPerKey and DefaultSessionTimeout
+// bound the sessions an encrypting Server keeps.
+var (
+	DefaultMaxSessions       = 4096
+	DefaultMaxSessionsPerKey = 4
+	DefaultSessionTimeout    = 10 * time.Minute
+)
+
+// Hello is the argument of the handshake: the client's identity key and a
+// fresh ephemeral key, signed with the former together with the time of the
+// handshake and the key of the server, if the client knows it.
+type Hello struct {
+	Key       []byte
+	Recipient []byte
+	Time      int64
+	Ephemeral []byte
+	Signature []byte
+}
+
+// Welcome is the server's answer to a Hello: its identity key, a fresh
+// ephemeral key and the ID of the new session, with a signature that covers
+// both sides of the handshake.
+type Welcome struct {
+	Key       []byte
+	Ephemeral []byte
+	Session   []byte
+	Signature []byte
+}
+
+// SealedMessage is the envelope of an encrypted Call, BatchRequest or reply.
+// Counter numbers the messages sent in one direction of the session and is
+// never repeated; the server and client drop messages whose counter they
+// have seen before.
+type SealedMessage struct {
+	Session    []byte
+	Counter    int64
+	Ciphertext []byte
+}
+
+// handshakeMethod is the method name of the handshake, which the server
+// handles itself instead of passing it to a registered service.
+const handshakeMethod = "bsonrpc.Handshake"
+
+var (
+	helloContext   = []byte("bsonrpc hello\x00")
+	welcomeContext = []byte("bsonrpc welcome\x00")
+)
+
+// ErrUnencrypted is the error of requests and replies that are sent in the
+// clear to a server or client that requires encryption.
+var ErrUnencrypted = errors.New("bsonrpc: message is not encrypted")
+
+// WithEncryption makes the server require every request but the handshake
+// to be encrypted, and encrypt its replies. It needs a signing key.
+func WithEncryption() ServerOption {
+	return func(s *Server) {
+		s.encrypt = true
+	}
+}
+
+// WithClientEncryption makes the client set up an encrypted session with
+// the server before its first call and send every call through it. It needs
+// a signing key.
+func WithClientEncryption() ClientOption {
+	return func(c *Client) {
+		c.encrypt = true
+	}
+}
+
+// session is one end of an encrypted session.
+type session struct {
+	id      []byte
+	peer    ed25519.PublicKey
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	counter atomic.Uint64
+
+	m        sync.Mutex
+	window   replayWindow
+	lastUsed time.Time
+
+	// established is guarded by the sessionCache holding the session.
+	established bool
+}
+
+// newSession derives the keys of a session from the shared secret of the
+// handshake and a hash of its transcript. The initiator sends with the
+// request key and receives with the reply key, the other end the reverse.
+func newSession(id []byte, peer ed25519.PublicKey, secret, transcript []byte, initiator bool) (*session, error) {
+	requestKey, err := newAEAD(deriveKey(secret, transcript, "bsonrpc request key"))
+	if err != nil {
+		return nil, err
+	}
+	replyKey, err := newAEAD(deriveKey(secret, transcript, "bsonrpc reply key"))
+	if err != nil {
+		return nil, err
+	}
+	sess := &session{id: id, peer: peer, send: replyKey, recv: requestKey, lastUsed: time.Now()}
+	if initiator {
+		sess.send, sess.recv = requestKey, replyKey
+	}
+	return sess, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey is HKDF-SHA256 producing a single 32-byte key.
+func deriveKey(secret, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// helloBytes returns what the signature of a Hello covers.
+func helloBytes(hello Hello) []byte {
+	b := append([]byte(nil), helloContext...)
+	b = binary.BigEndian.AppendUint64(b, uint64(hello.Time))
+	b = append(b, byte(len(hello.Recipient)))
+	b = append(b, hello.Recipient...)
+	return append(b, hello.Ephemeral...)
+}
+
+// transcript hashes the values exchanged in a handshake.
+func transcript(hello Hello, welcome Welcome) []byte {
+	h := sha256.New()
+	for _, b := range [][]byte{hello.Key, hello.Ephemeral, welcome.Key, welcome.Ephemeral, welcome.Session} {
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+func nonce(counter uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], counter)
+	return n
+}
+
+// seal encrypts payload as the next message of the session.
+func (sess *session) seal(payload []byte) ([]byte, error) {
+	counter := sess.counter.Add(1)
+	return bson.Marshal(SealedMessage{
+		Session:    sess.id,
+		Counter:    int64(counter),
+		Ciphertext: sess.send.Seal(nil, nonce(counter), payload, sess.id),
+	})
+}
+
+// open decrypts a message of the session, refusing any it has already
+// accepted.
+func (sess *session) open(msg SealedMessage) ([]byte, error) {
+	counter := uint64(msg.Counter)
+	payload, err := sess.recv.Open(nil, nonce(counter), msg.Ciphertext, sess.id)
+	if err != nil {
+		return nil, fmt.Errorf("bsonrpc: cannot decrypt message: %w", err)
+	}
+	sess.m.Lock()
+	defer sess.m.Unlock()
+	if !sess.window.accept(counter) {
+		return nil, errors.New("bsonrpc: replayed message")
+	}
+	sess.lastUsed = time.Now()
+	return payload, nil
+}
+
+// replayWindowSize is how many counters up to the highest one received a
+// replayWindow keeps track of. Messages sealed concurrently may be sent in
+// a different order than their counters, so it is wide enough for that.
+const replayWindowSize = 1024
+
+// replayWindow remembers which of the last replayWindowSize counters up to
+// the highest one received have been seen. Counter c is bit c mod
+// replayWindowSize of seen.
+type replayWindow struct {
+	top  uint64
+	seen [replayWindowSize / 64]uint64
+}
+
+// accept reports whether counter is new and recent enough to be checked,
+// and records it as seen.
+func (w *replayWindow) accept(counter uint64) bool {
+	switch {
+	case counter == 0:
+		return false
+	case counter > w.top:
+		if counter-w.top >= replayWindowSize {
+			clear(w.seen[:])
+		} else {
+			for c := w.top + 1; c < counter; c++ {
+				w.seen[c/64%uint64(len(w.seen))] &^= 1 << (c % 64)
+			}
+		}
+		w.top = counter
+	case w.top-counter >= replayWindowSize:
+		return false
+	case w.seen[counter/64%uint64(len(w.seen))]&(1<<(counter%64)) != 0:
+		return false
+	}
+	w.seen[counter/64%uint64(len(w.seen))] |= 1 << (counter % 64)
+	return true
+}
+
+// readSealed decodes data as a SealedMessage, reporting false if it is some
+// other message.
+func readSealed(data []byte) (msg SealedMessage, ok bool, err error) {
+	doc, err := bson.NewReader(data).ReadDocument()
+	if err != nil {
+		return SealedMessage{}, false, err
+	}
+	if _, ok := doc.Pairs["Ciphertext"]; !ok {
+		return SealedMessage{}, false, nil
+	}
+	if err := bson.Unmarshal(data, &msg); err != nil {
+		return SealedMessage{}, false, err
+	}
+	return msg, true, nil
+}
+
+// sessionCache holds the sessions of a server by ID. A session is pending
+// from the handshake until the first message sent through it, and pending
+// sessions are evicted only to make room for other pending ones, so that
+// handshakes alone cannot push out the sessions in use. A new session for a
+// key that already holds maxPerKey replaces the least recently used of them.
+type sessionCache struct {
+	m         sync.Mutex
+	sessions  map[string]*session
+	pending   map[string]*session
+	byKey     map[string][]*session
+	max       int
+	maxPerKey int
+	timeout   time.Duration
+}
+
+func newSessionCache(max, maxPerKey int, timeout time.Duration) *sessionCache {
+	return &sessionCache{
+		sessions:  make(map[string]*session),
+		pending:   make(map[string]*session),
+		byKey:     make(map[string][]*session),
+		max:       max,
+		maxPerKey: maxPerKey,
+		timeout:   timeout,
+	}
+}
+
+func (sc *sessionCache) get(id []byte) (*session, bool) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	sess, ok := sc.sessions[string(id)]
+	if !ok {
+		sess, ok = sc.pending[string(id)]
+	}
+	if ok && sc.expired(sess, time.Now()) {
+		sc.remove(sess)
+		return nil, false
+	}
+	return sess, ok
+}
+
+// add stores a new pending session, first dropping the least recently used
+// session of the same key if it has too many, and the oldest pending session
+// if there are too many of those.
+func (sc *sessionCache) add(sess *session) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	if same := sc.byKey[string(sess.peer)]; len(same) >= sc.maxPerKey {
+		sc.remove(leastRecentlyUsed(same))
+	}
+	sc.makeRoom(sc.pending)
+	sc.pending[string(sess.id)] = sess
+	sc.byKey[string(sess.peer)] = append(sc.byKey[string(sess.peer)], sess)
+}
+
+// establish makes a pending session count as in use, now that a message has
+// come through it.
+func (sc *sessionCache) establish(sess *session) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	if sess.established || sc.pending[string(sess.id)] != sess {
+		return
+	}
+	delete(sc.pending, string(sess.id))
+	sc.makeRoom(sc.sessions)
+	sess.established = true
+	sc.sessions[string(sess.id)] = sess
+}
+
+// makeRoom drops expired sessions from sessions, which is either the pending
+// or the established ones, if it is full, and then the least recently used
+// one if it is still full.
+func (sc *sessionCache) makeRoom(sessions map[string]*session) {
+	if len(sessions) < sc.max {
+		return
+	}
+	now := time.Now()
+	var all []*session
+	for _, sess := range sessions {
+		if sc.expired(sess, now) {
+			sc.remove(sess)
+		} else {
+			all = append(all, sess)
+		}
+	}
+	if len(sessions) >= sc.max && len(all) > 0 {
+		sc.remove(leastRecentlyUsed(all))
+	}
+}
+
+// remove forgets sess.
+func (sc *sessionCache) remove(sess *session) {
+	if sess.established {
+		delete(sc.sessions, string(sess.id))
+	} else {
+		delete(sc.pending, string(sess.id))
+	}
+	same := sc.byKey[string(sess.peer)]
+	for i, other := range same {
+		if other == sess {
+			same = append(same[:i:i], same[i+1:]...)
+			break
+		}
+	}
+	if len(same) == 0 {
+		delete(sc.byKey, string(sess.peer))
+	} else {
+		sc.byKey[string(sess.peer)] = same
+	}
+}
+
+func leastRecentlyUsed(sessions []*session) *session {
+	var oldest *session
+	for _, sess := range sessions {
+		if oldest == nil || sess.used().Before(oldest.used()) {
+			oldest = sess
+		}
+	}
+	return oldest
+}
+
+func (sc *sessionCache) expired(sess *session, now time.Time) bool {
+	return now.Sub(sess.used()) > sc.timeout
+}
+
+func (sess *session) used() time.Time {
+	sess.m.Lock()
+	defer sess.m.Unlock()
+	return sess.lastUsed
+}
+
+// acceptHandshake checks a Hello, creates the pending session it asks for
+// and returns the Welcome that lets the client derive the same keys.
+func (s *Server) acceptHandshake(raw *bson.Raw) (any, error) {
+	args, err := decodeArgs(raw, reflect.TypeOf(Hello{}))
+	if err != nil {
+		return nil, &Error{Code: CodeInvalidRequest, Message: "invalid handshake: " + err.Error()}
+	}
+	hello := args.Interface().(Hello)
+	if len(hello.Key) != ed25519.PublicKeySize ||
+		(len(hello.Recipient) != 0 && len(hello.Recipient) != ed25519.PublicKeySize) ||
+		!ed25519.Verify(hello.Key, helloBytes(hello), hello.Signature) {
+		return nil, &Error{Code: CodeInvalidRequest, Message: "invalid handshake: " + ErrBadSignature.Error()}
+	}
+	now := time.Now()
+	if checkAddressed(hello.Recipient, hello.Time, s.key, now) != nil || !s.nonces.accept(hello.Ephemeral, hello.Time, now) {
+		return nil, &Error{Code: CodeInvalidRequest, Message: "invalid handshake: " + ErrReplayed.Error()}
+	}
+	clientEphemeral, err := ecdh.X25519().NewPublicKey(hello.Ephemeral)
+	if err != nil {
+		return nil, &Error{Code: CodeInvalidRequest, Message: "invalid handshake: " + err.Error()}
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ephemeral.ECDH(clientEphemeral)
+	if err != nil {
+		return nil, &Error{Code: CodeInvalidRequest, Message: "invalid handshake: " + err.Error()}
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	welcome := Welcome{
+		Key:       s.key.Public().(ed25519.PublicKey),
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+		Session:   id,
+	}
+	hash := transcript(hello, welcome)
+	welcome.Signature = ed25519.Sign(s.key, append(append([]byte(nil), welcomeContext...), hash...))
+	sess, err := newSession(id, hello.Key, secret, hash, false)
+	if err != nil {
+		return nil, err
+	}
+	s.sessions.add(sess)
+	return welcome, nil
+}
+
+// openRequest decrypts an encrypted request, or checks the signature of one
+// sent in the clear, and returns it as the Payload of its envelope, whose Key
+// is that of its sender, along with the session it came through, if any.
+func (s *Server) openRequest(data []byte) (SignedMessage, *session, error) {
+	sealed, ok, err := readSealed(data)
+	if err != nil {
+		return SignedMessage{}, nil, err
+	}
+	if !ok {
+		msg, err := open(requestContext, data)
+		if err == nil && msg.Key != nil {
+			now := time.Now()
+			err = checkAddressed(msg.Recipient, msg.Time, s.key, now)
+			if err == nil && !s.nonces.accept(msg.Nonce, msg.Time, now) {
+				err = ErrReplayed
+			}
+		}
+		if err != nil {
+			return SignedMessage{}, nil, err
+		}
+		return msg, nil, nil
+	}
+	if s.sessions == nil {
+		return SignedMessage{}, nil, &Error{Code: CodeUnknownSession, Message: "encryption is not enabled"}
+	}
+	sess, ok := s.sessions.get(sealed.Session)
+	if !ok {
+		return SignedMessage{}, nil, &Error{Code: CodeUnknownSession, Message: fmt.Sprintf("%x", sealed.Session)}
+	}
+	payload, err := sess.open(sealed)
+	if err != nil {
+		return SignedMessage{}, nil, err
+	}
+	s.sessions.establish(sess)
+	return SignedMessage{Key: sess.peer, Payload: payload}, sess, nil
+}
+
+// establish returns the client's session, setting one up if there is none.
+// Concurrent callers share a single handshake.
+func (c *Client) establish(ctx context.Context) (*session, error) {
+	c.m.Lock()
+	for c.session == nil && c.handshaking != nil {
+		wait := c.handshaking
+		c.m.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.m.Lock()
+	}
+	if c.session != nil {
+		sess := c.session
+		c.m.Unlock()
+		return sess, nil
+	}
+	done := make(chan struct{})
+	c.handshaking = done
+	c.m.Unlock()
+
+	sess, err := c.handshake(ctx)
+
+	c.m.Lock()
+	c.handshaking = nil
+	if err == nil {
+		c.session = sess
+	}
+	c.m.Unlock()
+	close(done)
+	return sess, err
+}
+
+// handshake sends a Hello and derives a session from the server's Welcome.
+func (c *Client) handshake(ctx context.Context) (*session, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hello := Hello{
+		Key:       c.key.Public().(ed25519.PublicKey),
+		Recipient: recipient(ctx),
+		Time:      time.Now().UnixNano(),
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+	}
+	hello.Signature = ed25519.Sign(c.key, helloBytes(hello))
+
+	var welcome Welcome
+	call := &PendingCall{Method: handshakeMethod, Args: hello, Reply: &welcome, Done: make(chan *PendingCall, 1), plain: true}
+	c.start(ctx, call)
+	<-call.Done
+	if call.Error != nil {
+		return nil, fmt.Errorf("bsonrpc: handshake with %s failed: %w", c.address, call.Error)
+	}
+
+	hash := transcript(hello, welcome)
+	if len(welcome.Key) != ed25519.PublicKeySize ||
+		!ed25519.Verify(welcome.Key, append(append([]byte(nil), welcomeContext...), hash...), welcome.Signature) {
+		return nil, fmt.Errorf("bsonrpc: handshake with %s failed: %w", c.address, ErrBadSignature)
+	}
+	serverEphemeral, err := ecdh.X25519().NewPublicKey(welcome.Ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("bsonrpc: handshake with %s failed: %w", c.address, err)
+	}
+	secret, err := ephemeral.ECDH(serverEphemeral)
+	if err != nil {
+		return nil, fmt.Errorf("bsonrpc: handshake with %s failed: %w", c.address, err)
+	}
+	return newSession(welcome.Session, welcome.Key, secret, hash, true)
+}
+
+// currentSession returns the client's session, if it has one.
+func (c *Client) currentSession() *session {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.session
+}
+
+// dropSession forgets sess, unless the client has already replaced it.
+func (c *Client) dropSession(sess *session) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.session == sess {
+		c.session = nil
+	}
+}
+
+// openReply decrypts an encrypted reply, or checks the signature of one sent
+// in the clear, and returns it as the Payload of its envelope, whose Key is
+// that of the server, along with the session it came through, if any. Which
+// request a signed reply answers is checked once it has been matched to its
+// call.
+func (c *Client) openReply(data []byte) (SignedMessage, *session, error) {
+	sealed, ok, err := readSealed(data)
+	if err != nil {
+		return SignedMessage{}, nil, err
+	}
+	if !ok {
+		msg, err := open(replyContext, data)
+		if err == nil && msg.Key != nil {
+			err = checkAddressed(msg.Recipient, msg.Time, c.key, time.Now())
+		}
+		if err != nil {
+			return SignedMessage{}, nil, err
+		}
+		return msg, nil, nil
+	}
+	sess := c.currentSession()
+	if sess == nil || !bytes.Equal(sess.id, sealed.Session) {
+		return SignedMessage{}, nil, fmt.Errorf("bsonrpc: reply for unknown session %x", sealed.Session)
+	}
+	payload, err := sess.open(sealed)
+	if err != nil {
+		return SignedMessage{}, nil, err
+	}
+	return SignedMessage{Key: sess.peer, Payload: payload}, sess, nil
+}
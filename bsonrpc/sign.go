@@ -0,0 +1,252 @@
+package bsonrpc
+
+import (
+	"container/heap"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-dht/bson"
+	"sync"
+	"time"
+)
+
+// SignedMessage is the envelope of a Call, BatchRequest or reply sent by a
+// client or server that has a signing key. Signature is the Ed25519
+// signature by Key of Payload, the encoded message, together with the key of
+// the Recipient it is meant for, if the sender knows it, the Time it was
+// signed at, a random Nonce and, for a reply to a signed request, the Nonce
+// of that request as InReplyTo. The signed bytes are prefixed with whether
+// the message is a request or a reply so that one cannot be passed off as
+// the other.
+type SignedMessage struct {
+	Key       []byte
+	Recipient []byte
+	Time      int64
+	Nonce     []byte
+	InReplyTo []byte
+	Signature []byte
+	Payload   []byte
+}
+
+var (
+	requestContext = []byte("bsonrpc request\x00")
+	replyContext   = []byte("bsonrpc reply\x00")
+)
+
+// nonceSize is the length of the Nonce of a SignedMessage.
+const nonceSize = 16
+
+// DefaultMaxClockSkew is how far the Time of a signed message may be from
+// the clock of its recipient, and DefaultMaxNonces how many nonces of signed
+// requests a Server remembers to refuse replays within that window.
+var (
+	DefaultMaxClockSkew = 2 * time.Minute
+	DefaultMaxNonces    = 1 << 16
+)
+
+// ErrBadSignature is returned for signed messages whose signature does not
+// verify.
+var ErrBadSignature = errors.New("bsonrpc: bad signature")
+
+// ErrReplayed is returned for signed messages that are addressed to another
+// key, were signed too long ago or have already been received, and for
+// signed replies that answer another request.
+var ErrReplayed = errors.New("bsonrpc: replayed message")
+
+// WithSigningKey makes the server sign its replies with key.
+func WithSigningKey(key ed25519.PrivateKey) ServerOption {
+	return func(s *Server) {
+		s.key = key
+	}
+}
+
+// WithClientSigningKey makes the client sign its calls with key.
+func WithClientSigningKey(key ed25519.PrivateKey) ClientOption {
+	return func(c *Client) {
+		c.key = key
+	}
+}
+
+type signerCheckKey struct{}
+
+// WithSignerCheck returns a context that makes calls fail unless check
+// accepts the public key their reply was signed with, or that of the server
+// whose encrypted session it came through, and nil if neither.
+func WithSignerCheck(ctx context.Context, check func(ed25519.PublicKey) error) context.Context {
+	return context.WithValue(ctx, signerCheckKey{}, check)
+}
+
+func signerCheck(ctx context.Context) func(ed25519.PublicKey) error {
+	check, _ := ctx.Value(signerCheckKey{}).(func(ed25519.PublicKey) error)
+	return check
+}
+
+type recipientKey struct{}
+
+// WithRecipient returns a context that addresses the signed calls made with
+// it to the server whose key is key, so that other servers refuse them.
+func WithRecipient(ctx context.Context, key ed25519.PublicKey) context.Context {
+	return context.WithValue(ctx, recipientKey{}, key)
+}
+
+func recipient(ctx context.Context) ed25519.PublicKey {
+	key, _ := ctx.Value(recipientKey{}).(ed25519.PublicKey)
+	return key
+}
+
+// seal wraps an encoded message in a SignedMessage addressed to recipient
+// and answering the request whose nonce is inReplyTo, either of which may be
+// nil, and returns it along with its nonce. The message is returned unchanged
+// if key is nil.
+func seal(key ed25519.PrivateKey, context []byte, recipient ed25519.PublicKey, inReplyTo, payload []byte) ([]byte, []byte, error) {
+	if key == nil {
+		return payload, nil, nil
+	}
+	msg := SignedMessage{
+		Key:       key.Public().(ed25519.PublicKey),
+		Recipient: recipient,
+		Time:      time.Now().UnixNano(),
+		Nonce:     make([]byte, nonceSize),
+		InReplyTo: inReplyTo,
+		Payload:   payload,
+	}
+	if _, err := rand.Read(msg.Nonce); err != nil {
+		return nil, nil, err
+	}
+	msg.Signature = ed25519.Sign(key, signedBytes(context, msg))
+	data, err := bson.Marshal(msg)
+	return data, msg.Nonce, err
+}
+
+// signedBytes returns what the signature of msg covers.
+func signedBytes(context []byte, msg SignedMessage) []byte {
+	b := append([]byte(nil), context...)
+	b = binary.BigEndian.AppendUint64(b, uint64(msg.Time))
+	b = append(b, msg.Nonce...)
+	b = append(b, byte(len(msg.InReplyTo)))
+	b = append(b, msg.InReplyTo...)
+	b = append(b, byte(len(msg.Recipient)))
+	b = append(b, msg.Recipient...)
+	return append(b, msg.Payload...)
+}
+
+// open checks the signature of a SignedMessage and returns it. Messages
+// that are not signed are returned as the Payload of an envelope with no
+// Key.
+func open(context []byte, data []byte) (msg SignedMessage, err error) {
+	doc, err := bson.NewReader(data).ReadDocument()
+	if err != nil {
+		return SignedMessage{}, err
+	}
+	if _, ok := doc.Pairs["Payload"]; !ok {
+		return SignedMessage{Payload: data}, nil
+	}
+	for _, name := range []string{"Key", "Recipient", "Nonce", "InReplyTo", "Signature", "Payload"} {
+		if raw, ok := doc.Pairs[name]; !ok || raw.Type != bson.BinData {
+			return SignedMessage{}, fmt.Errorf("signed message has no %s", name)
+		}
+	}
+	if err := bson.Unmarshal(data, &msg); err != nil {
+		return SignedMessage{}, err
+	}
+	if len(msg.Key) != ed25519.PublicKeySize || len(msg.Nonce) != nonceSize ||
+		(len(msg.InReplyTo) != 0 && len(msg.InReplyTo) != nonceSize) ||
+		(len(msg.Recipient) != 0 && len(msg.Recipient) != ed25519.PublicKeySize) ||
+		!ed25519.Verify(msg.Key, signedBytes(context, msg), msg.Signature) {
+		return SignedMessage{}, ErrBadSignature
+	}
+	return msg, nil
+}
+
+// checkAddressed returns ErrReplayed unless a message for recipient, signed
+// at signed, is addressed to the holder of self, or to no one in particular,
+// and was signed within DefaultMaxClockSkew of now.
+func checkAddressed(recipient []byte, signed int64, self ed25519.PrivateKey, now time.Time) error {
+	if len(recipient) != 0 && (self == nil || !self.Public().(ed25519.PublicKey).Equal(ed25519.PublicKey(recipient))) {
+		return ErrReplayed
+	}
+	skew := now.Sub(time.Unix(0, signed))
+	if skew > DefaultMaxClockSkew || skew < -DefaultMaxClockSkew {
+		return ErrReplayed
+	}
+	return nil
+}
+
+// nonceCache remembers the nonces of the signed requests, and the ephemeral
+// keys of the handshakes, a server has accepted until they are too old to
+// pass checkAddressed, so that none is accepted twice. Once it holds max
+// nonces it forgets the oldest, and from then on refuses messages signed no
+// later than the ones it forgot.
+type nonceCache struct {
+	m      sync.Mutex
+	nonces map[string]bool
+	byTime nonceHeap
+	max    int
+	floor  int64
+}
+
+func newNonceCache(max int) *nonceCache {
+	return &nonceCache{nonces: make(map[string]bool), max: max}
+}
+
+// accept reports whether nonce, of a message signed at signed, is new, and
+// records it.
+func (nc *nonceCache) accept(nonce []byte, signed int64, now time.Time) bool {
+	nc.m.Lock()
+	defer nc.m.Unlock()
+
+	expired := now.Add(-DefaultMaxClockSkew).UnixNano()
+	for len(nc.byTime) > 0 && nc.byTime[0].time < expired {
+		nc.forget()
+	}
+	if signed <= nc.floor || nc.nonces[string(nonce)] {
+		return false
+	}
+	if len(nc.byTime) >= nc.max {
+		nc.floor = nc.byTime[0].time
+		nc.forget()
+	}
+	nc.nonces[string(nonce)] = true
+	heap.Push(&nc.byTime, seenNonce{nonce: string(nonce), time: signed})
+	return true
+}
+
+// forget drops the oldest nonce.
+func (nc *nonceCache) forget() {
+	oldest := heap.Pop(&nc.byTime).(seenNonce)
+	delete(nc.nonces, oldest.nonce)
+}
+
+type seenNonce struct {
+	nonce string
+	time  int64
+}
+
+// nonceHeap orders nonces by the time their message was signed at.
+type nonceHeap []seenNonce
+
+func (h nonceHeap) Len() int {
+	return len(h)
+}
+
+func (h nonceHeap) Less(i, j int) bool {
+	return h[i].time < h[j].time
+}
+
+func (h nonceHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *nonceHeap) Push(x any) {
+	*h = append(*h, x.(seenNonce))
+}
+
+func (h *nonceHeap) Pop() any {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
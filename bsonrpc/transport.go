@@ -0,0 +1,192 @@
+package bsonrpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Networks a Server can listen on and a Client can dial.
+const (
+	UDP = "udp"
+	TCP = "tcp"
+)
+
+// transport carries the encoded messages of one Client.
+type transport interface {
+	send(seq uint64, data []byte) error
+	// recv returns the next complete message. A message over the size limit
+	// is reported as ErrMessageTooLarge along with its sequence number; any
+	// other error means the transport can no longer be used.
+	recv() (uint64, []byte, error)
+	Close() error
+}
+
+// peer is where a Server sends the reply to a request.
+type peer interface {
+	send(seq uint64, data []byte) error
+	String() string
+}
+
+func dialTransport(packets Network, network, host string, port int, maxSize int) (transport, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	switch network {
+	case UDP:
+		conn, err := packets.DialPacket(host, port)
+		if err != nil {
+			return nil, err
+		}
+		return &udpTransport{conn: conn, maxSize: maxSize, fragments: newReassembler(maxSize)}, nil
+	case TCP:
+		if packets != UDPNetwork {
+			return nil, fmt.Errorf("bsonrpc: %s is not available on this network", TCP)
+		}
+		conn, err := net.DialTimeout(TCP, address, DefaultTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return newTCPTransport(conn, maxSize), nil
+	}
+	return nil, fmt.Errorf("bsonrpc: unknown network %q", network)
+}
+
+type udpTransport struct {
+	conn      net.Conn
+	maxSize   int
+	fragments *reassembler
+	buf       []byte
+}
+
+func (t *udpTransport) send(seq uint64, data []byte) error {
+	datagrams, err := fragment(seq, data, t.maxSize)
+	if err != nil {
+		return err
+	}
+	for _, d := range datagrams {
+		if _, err := t.conn.Write(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recv skips over read errors other than the socket being closed, such as
+// the ones reported after an ICMP port unreachable, and over datagrams that
+// are not valid fragments.
+func (t *udpTransport) recv() (uint64, []byte, error) {
+	if t.buf == nil {
+		t.buf = make([]byte, maxDatagramSize)
+	}
+	for {
+		n, err := t.conn.Read(t.buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return 0, nil, err
+			}
+			continue
+		}
+		seq, data, err := t.fragments.add("", t.buf[:n])
+		if err != nil && !errors.Is(err, ErrMessageTooLarge) {
+			log.Println("Error reading reply: " + err.Error())
+			continue
+		}
+		if err != nil || data != nil {
+			return seq, data, err
+		}
+	}
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
+
+// tcpTransport sends each message as one frame on a stream connection:
+//
+//	[size uint32][seq uint64][payload]
+type tcpTransport struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	m       sync.Mutex
+	maxSize int
+}
+
+const frameHeaderSize = 12
+
+func newTCPTransport(conn net.Conn, maxSize int) *tcpTransport {
+	return &tcpTransport{conn: conn, r: bufio.NewReader(conn), maxSize: maxSize}
+}
+
+func (t *tcpTransport) send(seq uint64, data []byte) error {
+	if len(data) > t.maxSize {
+		return ErrMessageTooLarge
+	}
+	frame := make([]byte, frameHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint64(frame[4:12], seq)
+	copy(frame[frameHeaderSize:], data)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	_, err := t.conn.Write(frame)
+	return err
+}
+
+// recv reads the next frame. The payload of a frame over the size limit is
+// read and discarded so that the stream stays usable.
+func (t *tcpTransport) recv() (uint64, []byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(t.r, header); err != nil {
+		return 0, nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(header[0:4]))
+	seq := binary.LittleEndian.Uint64(header[4:12])
+	if size > int64(t.maxSize) {
+		if _, err := io.CopyN(io.Discard, t.r, size); err != nil {
+			return 0, nil, err
+		}
+		return seq, nil, ErrMessageTooLarge
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(t.r, data); err != nil {
+		return 0, nil, err
+	}
+	return seq, data, nil
+}
+
+func (t *tcpTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *tcpTransport) String() string {
+	return t.conn.RemoteAddr().String()
+}
+
+// udpPeer replies to a request that arrived on the server's UDP socket.
+type udpPeer struct {
+	conn    net.PacketConn
+	addr    net.Addr
+	maxSize int
+}
+
+func (p udpPeer) send(seq uint64, data []byte) error {
+	datagrams, err := fragment(seq, data, p.maxSize)
+	if err != nil {
+		return err
+	}
+	for _, d := range datagrams {
+		if _, err := p.conn.WriteTo(d, p.addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p udpPeer) String() string {
+	return p.addr.String()
+}
@@ -0,0 +1,463 @@
+// Package diskstore implements a kademlia.Store that survives restarts. Every
+// Put and Delete is appended to a log file as a length-prefixed, CRC-checked
+// BSON record and synced to disk before it returns; an in-memory index maps
+// each key to its latest record.
+package diskstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-dht/bson"
+	"go-dht/kademlia"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const headerSize = 8
+
+// CompactInterval is how often the background compactor checks whether the
+// log has accumulated enough stale records to be rewritten.
+var CompactInterval = 10 * time.Minute
+
+// CompactRatio is the fraction of the log that must be stale before it is
+// compacted in the background.
+var CompactRatio = 0.5
+
+type location struct {
+	offset int64
+	size   int64
+}
+
+// logFile is the part of an *os.File the store reads and writes its log
+// through once it has been recovered.
+type logFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+type Store struct {
+	m     sync.RWMutex
+	path  string
+	file  logFile
+	size  int64
+	stale int64
+	index map[string]location
+	done  chan struct{}
+	wg    sync.WaitGroup
+	once  sync.Once
+}
+
+var _ kademlia.Store = (*Store)(nil)
+
+// Open opens or creates the log at path and rebuilds the index from it. A
+// torn or corrupt record at the end of the log, as left by a crash during a
+// write, is truncated away.
+func Open(path string) (*Store, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		path:  path,
+		file:  file,
+		index: make(map[string]location),
+		done:  make(chan struct{}),
+	}
+	if err := s.recover(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.compactLoop()
+	return s, nil
+}
+
+func (s *Store) recover(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(file)
+	var offset int64
+	for {
+		rec, size, err := readRecord(r, info.Size()-offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("diskstore: truncating %s at offset %d: %s", s.path, offset, err)
+			if err := file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		s.apply(rec, location{offset: offset, size: size})
+		offset += size
+	}
+	s.size = offset
+	return nil
+}
+
+func (s *Store) apply(rec diskRecord, loc location) {
+	if old, ok := s.index[rec.Key]; ok {
+		s.stale += old.size
+	}
+	if rec.Deleted {
+		delete(s.index, rec.Key)
+		s.stale += loc.size
+		return
+	}
+	s.index[rec.Key] = loc
+}
+
+func (s *Store) Get(key string) (kademlia.Record, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	loc, ok := s.index[key]
+	if !ok {
+		return kademlia.Record{}, kademlia.ErrNotFound
+	}
+	rec, err := s.read(loc)
+	if err != nil {
+		return kademlia.Record{}, err
+	}
+	return rec.record(), nil
+}
+
+func (s *Store) Put(r kademlia.Record) error {
+	return s.append(newDiskRecord(r))
+}
+
+func (s *Store) Update(key string, fn func(r *kademlia.Record, found bool) bool) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	r := kademlia.Record{Key: key}
+	loc, found := s.index[key]
+	if found {
+		rec, err := s.read(loc)
+		if err != nil {
+			return err
+		}
+		r = rec.record()
+	}
+	if !fn(&r, found) {
+		return nil
+	}
+	return s.appendLocked(newDiskRecord(r))
+}
+
+func (s *Store) Delete(key string) error {
+	s.m.RLock()
+	_, ok := s.index[key]
+	s.m.RUnlock()
+	if !ok {
+		return nil
+	}
+	return s.append(diskRecord{Key: key, Deleted: true})
+}
+
+func (s *Store) Iterate(fn func(kademlia.Record) bool) error {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	for _, loc := range s.index {
+		rec, err := s.read(loc)
+		if err != nil {
+			return err
+		}
+		if !fn(rec.record()) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *Store) Len() int {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return len(s.index)
+}
+
+// Close stops the background compactor and closes the log. Closing a store
+// more than once has no effect.
+func (s *Store) Close() error {
+	var err error
+	s.once.Do(func() {
+		err = s.close()
+	})
+	return err
+}
+
+func (s *Store) close() error {
+	close(s.done)
+	s.wg.Wait()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *Store) append(rec diskRecord) error {
+	data, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.writeLocked(rec, data)
+}
+
+// appendLocked is append for callers that hold s.m.
+func (s *Store) appendLocked(rec diskRecord) error {
+	data, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+	return s.writeLocked(rec, data)
+}
+
+// writeLocked writes a record at the end of the log. The log is cut back to
+// its previous end if the write or the sync fails, so that a partly written
+// record neither shifts the records written after it nor, since it might
+// still reach the disk, outlives the failed call that wrote it.
+func (s *Store) writeLocked(rec diskRecord, data []byte) error {
+	_, err := s.file.WriteAt(data, s.size)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		if terr := s.file.Truncate(s.size); terr != nil {
+			log.Printf("diskstore: could not cut %s back after a failed write: %s", s.path, terr)
+		}
+		return err
+	}
+	loc := location{offset: s.size, size: int64(len(data))}
+	s.size += loc.size
+	s.apply(rec, loc)
+	return nil
+}
+
+func (s *Store) read(loc location) (diskRecord, error) {
+	buf := make([]byte, loc.size)
+	if _, err := s.file.ReadAt(buf, loc.offset); err != nil {
+		return diskRecord{}, err
+	}
+	return decodeRecord(buf)
+}
+
+// Compact rewrites the log so that it only contains the live records. The
+// new log replaces the old one by renaming it, which is made durable by
+// syncing the directory.
+func (s *Store) Compact() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	tmpPath := s.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]location, len(s.index))
+	var offset int64
+	for key, loc := range s.index {
+		buf := make([]byte, loc.size)
+		if _, err = s.file.ReadAt(buf, loc.offset); err != nil {
+			break
+		}
+		if _, err = tmp.Write(buf); err != nil {
+			break
+		}
+		index[key] = location{offset: offset, size: loc.size}
+		offset += loc.size
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.file.Close()
+	s.file = tmp
+	s.index = index
+	s.size = offset
+	s.stale = 0
+	return syncDir(filepath.Dir(s.path))
+}
+
+// syncDir flushes the entries of the directory at path, such as a file
+// renamed into it, to disk.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if cerr := dir.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *Store) needsCompaction() bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return s.size > 0 && float64(s.stale)/float64(s.size) >= CompactRatio
+}
+
+func (s *Store) compactLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if s.needsCompaction() {
+				if err := s.Compact(); err != nil {
+					log.Printf("diskstore: could not compact %s: %s", s.path, err)
+				}
+			}
+		}
+	}
+}
+
+// diskRecord is the BSON document written to the log. Times are stored as
+// Unix nanoseconds.
+type diskRecord struct {
+	Key       string
+	Value     any
+	StoredAt  int64
+	TTL       int64
+	Original  bool
+	Published int64
+	Deleted   bool
+}
+
+func newDiskRecord(r kademlia.Record) diskRecord {
+	return diskRecord{
+		Key:       r.Key,
+		Value:     r.Value,
+		StoredAt:  r.StoredAt.UnixNano(),
+		TTL:       int64(r.TTL),
+		Original:  r.Original,
+		Published: r.Published.UnixNano(),
+	}
+}
+
+func (rec diskRecord) record() kademlia.Record {
+	return kademlia.Record{
+		Key:       rec.Key,
+		Value:     rec.Value,
+		StoredAt:  time.Unix(0, rec.StoredAt),
+		TTL:       time.Duration(rec.TTL),
+		Original:  rec.Original,
+		Published: time.Unix(0, rec.Published),
+	}
+}
+
+func encodeRecord(rec diskRecord) ([]byte, error) {
+	payload, err := bson.Marshal(bson.M{
+		"Key":       rec.Key,
+		"Value":     rec.Value,
+		"StoredAt":  rec.StoredAt,
+		"TTL":       rec.TTL,
+		"Original":  rec.Original,
+		"Published": rec.Published,
+		"Deleted":   rec.Deleted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, headerSize+len(payload))
+	binary.LittleEndian.PutUint32(data[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(data[4:8], crc32.ChecksumIEEE(payload))
+	copy(data[headerSize:], payload)
+	return data, nil
+}
+
+// readRecord reads the next record from r, which has remaining bytes left.
+// A length in the header that runs past the end is reported as a truncated
+// record before anything is allocated for it, since the checksum does not
+// cover the header.
+func readRecord(r io.Reader, remaining int64) (diskRecord, int64, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return diskRecord{}, 0, errors.New("truncated record header")
+		}
+		return diskRecord{}, 0, err
+	}
+	size := binary.LittleEndian.Uint32(header[0:4])
+	if int64(size) > remaining-headerSize {
+		return diskRecord{}, 0, fmt.Errorf("record length %d runs past the end of the log", size)
+	}
+	data := make([]byte, headerSize+int(size))
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[headerSize:]); err != nil {
+		return diskRecord{}, 0, errors.New("truncated record")
+	}
+	rec, err := decodeRecord(data)
+	return rec, int64(len(data)), err
+}
+
+// decodeRecord verifies the checksum of a framed record and decodes it. The
+// document is read into a bson.M so that Value comes back as whatever BSON
+// type was written, independent of bson.TypeRegistry.
+func decodeRecord(data []byte) (diskRecord, error) {
+	if len(data) < headerSize {
+		return diskRecord{}, errors.New("truncated record header")
+	}
+	size := binary.LittleEndian.Uint32(data[0:4])
+	payload := data[headerSize:]
+	if int(size) != len(payload) {
+		return diskRecord{}, fmt.Errorf("record length %d does not match header %d", len(payload), size)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[4:8]) {
+		return diskRecord{}, errors.New("record checksum mismatch")
+	}
+
+	m := bson.M{}
+	if err := bson.Unmarshal(payload, &m); err != nil {
+		return diskRecord{}, err
+	}
+	var rec diskRecord
+	var ok bool
+	if rec.Key, ok = m["Key"].(string); !ok {
+		return diskRecord{}, errors.New("record has no key")
+	}
+	rec.Value = m["Value"]
+	rec.StoredAt, _ = m["StoredAt"].(int64)
+	rec.TTL, _ = m["TTL"].(int64)
+	rec.Original, _ = m["Original"].(bool)
+	rec.Published, _ = m["Published"].(int64)
+	rec.Deleted, _ = m["Deleted"].(bool)
+	return rec, nil
+}
@@ -0,0 +1,257 @@
+package diskstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"go-dht/kademlia"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	records := []kademlia.Record{
+		{Key: "a", Value: "first", StoredAt: now, TTL: time.Hour, Published: now},
+		{Key: "b", Value: []byte{0, 1, 2}, StoredAt: now, Original: true, Published: now},
+		{Key: "c", Value: int64(42), StoredAt: now, Published: now},
+	}
+	for _, r := range records {
+		if err := s.Put(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put(kademlia.Record{Key: "a", Value: "second", StoredAt: now, Published: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.Len() != 2 {
+		t.Errorf("Reopened store should contain 2 records, got %d", s.Len())
+	}
+	a, err := s.Get("a")
+	if err != nil || a.Value != "second" || !a.StoredAt.Equal(time.Unix(0, now.UnixNano())) {
+		t.Errorf("Reopened store should return the latest value for a key, got %+v (%v)", a, err)
+	}
+	b, err := s.Get("b")
+	if err != nil || !bytes.Equal(b.Value.([]byte), []byte{0, 1, 2}) || !b.Original {
+		t.Errorf("Binary values and metadata should survive a restart, got %+v (%v)", b, err)
+	}
+	if _, err := s.Get("c"); !errors.Is(err, kademlia.ErrNotFound) {
+		t.Errorf("Deleted keys should stay deleted after a restart")
+	}
+}
+
+func TestStore_RecoversFromTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := s.Put(kademlia.Record{Key: key, Value: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:len(data)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("a"); err != nil {
+		t.Errorf("Records before the torn write should be recovered: %s", err)
+	}
+	if s.Len() != 1 {
+		t.Errorf("The torn record should be dropped, got %d records", s.Len())
+	}
+	if err := s.Put(kademlia.Record{Key: "c", Value: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 2 {
+		t.Errorf("Writes after recovery should be readable after a restart, got %d records", s.Len())
+	}
+}
+
+// failingFile is a log file whose writes stop halfway while short is set
+// and whose syncs fail while failSync is set.
+type failingFile struct {
+	logFile
+	short    bool
+	failSync bool
+}
+
+func (f *failingFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.short {
+		n, _ := f.logFile.WriteAt(p[:len(p)/2], off)
+		return n, errors.New("disk full")
+	}
+	return f.logFile.WriteAt(p, off)
+}
+
+func (f *failingFile) Sync() error {
+	if f.failSync {
+		return errors.New("sync failed")
+	}
+	return f.logFile.Sync()
+}
+
+func TestStore_FailedWritesLeaveTheLogIntact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(kademlia.Record{Key: "a", Value: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	f := &failingFile{logFile: s.file, short: true}
+	s.file = f
+	if err := s.Put(kademlia.Record{Key: "b", Value: "b"}); err == nil {
+		t.Errorf("A short write should fail the Put")
+	}
+	f.short = false
+	if err := s.Put(kademlia.Record{Key: "d", Value: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	f.failSync = true
+	if err := s.Put(kademlia.Record{Key: "c", Value: "c"}); err == nil {
+		t.Errorf("A failed sync should fail the Put")
+	}
+	f.failSync = false
+
+	check := func(when string) {
+		t.Helper()
+		for _, key := range []string{"a", "d"} {
+			if r, err := s.Get(key); err != nil || r.Value != key {
+				t.Errorf("%s, %s should read back, got %+v (%v)", when, key, r, err)
+			}
+		}
+		for _, key := range []string{"b", "c"} {
+			if _, err := s.Get(key); !errors.Is(err, kademlia.ErrNotFound) {
+				t.Errorf("%s, the failed Put of %s should not be stored, got %v", when, key, err)
+			}
+		}
+	}
+	check("After failed writes")
+	s.Close()
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check("After a restart")
+}
+
+func TestStore_Compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := s.Put(kademlia.Record{Key: "a", Value: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put(kademlia.Record{Key: "b", Value: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.Stat(path)
+	if !s.needsCompaction() {
+		t.Errorf("A log of mostly overwritten records should need compaction")
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Errorf("Compaction should shrink the log from %d bytes, got %d", before.Size(), after.Size())
+	}
+
+	a, err := s.Get("a")
+	if err != nil || a.Value != int64(9) {
+		t.Errorf("Compaction should keep the latest value, got %+v (%v)", a, err)
+	}
+	if err := s.Put(kademlia.Record{Key: "c", Value: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 3 {
+		t.Errorf("Store should accept writes after compaction")
+	}
+}
+
+func TestStore_RecoversFromCorruptLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := s.Put(kademlia.Record{Key: key, Value: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Closing a store twice should have no effect, got %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := headerSize + int(binary.LittleEndian.Uint32(data[0:4]))
+	binary.LittleEndian.PutUint32(data[first:first+4], 0xffffffff)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Get("a"); err != nil || s.Len() != 1 {
+		t.Errorf("A record whose length runs past the end should be truncated away, got %d records (%v)", s.Len(), err)
+	}
+}
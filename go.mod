@@ -1,3 +1,3 @@
 module go-dht
 
-go 1.22
+go 1.25
@@ -0,0 +1,21 @@
+package kademlia
+
+import "time"
+
+// Clock is the source of time for a Server's maintenance tasks and stored
+// value timestamps. Tests can substitute their own implementation to drive
+// the timers deterministically.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
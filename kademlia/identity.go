@@ -0,0 +1,111 @@
+package kademlia
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"go-dht/bsonrpc"
+	"math/big"
+	"os"
+)
+
+// ErrUnsigned is returned for requests and replies that carry no signature.
+var ErrUnsigned = errors.New("message is not signed")
+
+// WithIdentity makes the server use key as its identity instead of a newly
+// generated one. The node ID is derived from the public key, so a node that
+// keeps its key keeps its ID across restarts.
+func WithIdentity(key ed25519.PrivateKey) ServerOption {
+	return func(s *Server) {
+		s.identity = key
+	}
+}
+
+// WithIdentityFile makes the server use the key stored at path as its
+// identity. If there is no file yet, a key is generated and saved there,
+// readable by its owner only, so that the node keeps its ID across restarts.
+// WithIdentity takes precedence over it.
+func WithIdentityFile(path string) ServerOption {
+	return func(s *Server) {
+		s.identityFile = path
+	}
+}
+
+// loadIdentity reads the private key whose seed is saved at path, generating
+// and saving a new one if the file does not exist. The file is replaced
+// atomically, so that a crash cannot leave half a key behind.
+func loadIdentity(path string) (ed25519.PrivateKey, error) {
+	seed, err := os.ReadFile(path)
+	if err == nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("identity file %s holds %d bytes, want %d", path, len(seed), ed25519.SeedSize)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, key.Seed(), 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// IdFromKey returns the ID of the node whose public key is key: its SHA-1
+// hash, the same way stored keys are mapped to IDs.
+func IdFromKey(key ed25519.PublicKey) *big.Int {
+	return keyId(string(key))
+}
+
+// ownsKey reports whether key is the public key of n, which is the case when
+// n carries key and n's ID is derived from it.
+func (n Node) ownsKey(key ed25519.PublicKey) bool {
+	return len(key) == ed25519.PublicKeySize && n.Id != nil &&
+		key.Equal(n.PublicKey) && IdFromKey(key).Cmp(n.Id) == 0
+}
+
+// authenticate rejects requests unless they are signed with, or come through
+// a session set up with, the public key of their sender, so that handlers
+// only add contacts to the routing table that hold the key behind their ID.
+func authenticate(info bsonrpc.RequestInfo, args any, next bsonrpc.Handler) (any, error) {
+	a, ok := args.(Args)
+	if !ok {
+		return next(args)
+	}
+	if info.Signer == nil {
+		return nil, fmt.Errorf("%s from %s: %w", info.Method, info.Peer, ErrUnsigned)
+	}
+	if !a.Sender.ownsKey(info.Signer) {
+		return nil, fmt.Errorf("%s from %s: sender %s does not own the key the request was signed with", info.Method, info.Peer, a.Sender)
+	}
+	return next(args)
+}
+
+// expectSigner returns a context for a call to other that fails unless the
+// reply is signed with the key behind other's ID, and stores that key in
+// signer. If other's ID is unknown, any key is accepted. When other's key is
+// known, the call is addressed to it so that no other node accepts it.
+func expectSigner(ctx context.Context, other Node, signer *ed25519.PublicKey) context.Context {
+	if other.PublicKey != nil {
+		ctx = bsonrpc.WithRecipient(ctx, other.PublicKey)
+	}
+	return bsonrpc.WithSignerCheck(ctx, func(key ed25519.PublicKey) error {
+		if key == nil {
+			return fmt.Errorf("reply from %s: %w", other, ErrUnsigned)
+		}
+		if other.Id != nil && IdFromKey(key).Cmp(other.Id) != 0 {
+			return fmt.Errorf("reply from %s is signed by node %s", other, IdFromKey(key).Text(16))
+		}
+		*signer = key
+		return nil
+	})
+}
@@ -4,35 +4,49 @@ import (
 	"fmt"
 	"math/big"
 	"math/rand"
+	"sync"
 	"time"
 )
 
 type ListNode struct {
-	Data Node
-	Next *ListNode
-	Prev *ListNode
+	Data     Node
+	LastSeen time.Time
+	Next     *ListNode
+	Prev     *ListNode
+	failures int
 }
 
 type KBucket struct {
-	Owner    Node
-	Capacity int
-	Head     *ListNode
-	Tail     *ListNode
-	Size     int
-	Prefix   string
-	lastUsed time.Time
+	m            sync.Mutex
+	Owner        Node
+	Capacity     int
+	Head         *ListNode
+	Tail         *ListNode
+	Size         int
+	Prefix       string
+	lastUsed     time.Time
+	clock        Clock
+	replacements []Node
+	pinging      bool
+	pinged       Node
 }
 
-func NewKBucket(owner Node, prefix string) *KBucket {
+// NewKBucket returns an empty bucket for the IDs starting with prefix, which
+// tells when it was last used by clock.
+func NewKBucket(owner Node, prefix string, clock Clock) *KBucket {
 	return &KBucket{
 		Owner:    owner,
 		Capacity: Options.BucketCapacity,
 		Prefix:   prefix,
-		lastUsed: time.Now(),
+		lastUsed: clock.Now(),
+		clock:    clock,
 	}
 }
 
 func (kb *KBucket) String() string {
+	kb.m.Lock()
+	defer kb.m.Unlock()
+
 	if kb.Head == nil {
 		return "<empty>"
 	}
@@ -49,25 +63,132 @@ func (kb *KBucket) String() string {
 	return res
 }
 
-func (kb *KBucket) Add(n Node) {
-	if kb.Capacity == kb.Size {
-		return
+// Add moves n to the tail of the bucket if it is already present, or appends
+// it when there is room. When the bucket is full, n is kept in the replacement
+// cache and the least-recently seen contact at the head is returned so the
+// caller can ping it. No contact is returned while a ping is outstanding.
+func (kb *KBucket) Add(n Node) (Node, bool) {
+	kb.m.Lock()
+	defer kb.m.Unlock()
+
+	return kb.add(n)
+}
+
+func (kb *KBucket) add(n Node) (Node, bool) {
+	kb.lastUsed = kb.clock.Now()
+	if kb.contains(n) {
+		kb.remove(n)
+	} else if kb.Size >= kb.Capacity {
+		kb.addReplacement(n)
+		if kb.pinging {
+			return Node{}, false
+		}
+		kb.pinging = true
+		kb.pinged = kb.Head.Data
+		return kb.pinged, true
 	}
-	kb.lastUsed = time.Now()
+	kb.removeReplacement(n)
+	newListNode := &ListNode{Data: n, LastSeen: kb.lastUsed}
 	if kb.Head == nil {
-		kb.Head = &ListNode{Data: n}
-		kb.Tail = kb.Head
+		kb.Head = newListNode
+		kb.Tail = newListNode
 		kb.Size++
-		return
-	}
-	if kb.contains(n) {
-		kb.remove(n)
+		return Node{}, false
 	}
-	newListNode := &ListNode{Data: n}
 	kb.Tail.Next = newListNode
 	newListNode.Prev = kb.Tail
 	kb.Tail = newListNode
 	kb.Size++
+	return Node{}, false
+}
+
+// Evict removes a contact that failed to respond and fills its slot with the
+// most recently seen contact from the replacement cache.
+func (kb *KBucket) Evict(n Node) {
+	kb.m.Lock()
+	defer kb.m.Unlock()
+
+	kb.evict(n)
+}
+
+func (kb *KBucket) evict(n Node) {
+	kb.donePinging(n)
+	if !kb.contains(n) {
+		kb.removeReplacement(n)
+		return
+	}
+	kb.remove(n)
+	if len(kb.replacements) > 0 {
+		last := len(kb.replacements) - 1
+		replacement := kb.replacements[last]
+		kb.replacements = kb.replacements[:last]
+		kb.add(replacement)
+	}
+}
+
+// Failed records that n did not answer an RPC and reports whether it was
+// evicted as a result. A contact is evicted once it has failed
+// Options.MaxFailures times in a row, or at once if a replacement is waiting
+// to take its place, so that occasional packet loss does not empty buckets.
+// Hearing from the contact again resets its count.
+func (kb *KBucket) Failed(n Node) bool {
+	kb.m.Lock()
+	defer kb.m.Unlock()
+
+	for ptr := kb.Head; ptr != nil; ptr = ptr.Next {
+		if !ptr.Data.Equals(n) {
+			continue
+		}
+		ptr.failures++
+		if ptr.failures < Options.MaxFailures && len(kb.replacements) == 0 {
+			return false
+		}
+		kb.evict(n)
+		return true
+	}
+	return false
+}
+
+// Responded records that the pinged head of the bucket is still alive, moving
+// it to the tail. The pending newcomers stay in the replacement cache.
+func (kb *KBucket) Responded(n Node) {
+	kb.m.Lock()
+	defer kb.m.Unlock()
+
+	kb.donePinging(n)
+	if kb.contains(n) {
+		kb.add(n)
+	}
+}
+
+func (kb *KBucket) donePinging(n Node) {
+	if kb.pinging && kb.pinged.Equals(n) {
+		kb.pinging = false
+	}
+}
+
+func (kb *KBucket) Replacements() []Node {
+	kb.m.Lock()
+	defer kb.m.Unlock()
+
+	return append([]Node(nil), kb.replacements...)
+}
+
+func (kb *KBucket) addReplacement(n Node) {
+	kb.removeReplacement(n)
+	kb.replacements = append(kb.replacements, n)
+	if len(kb.replacements) > Options.ReplacementCacheSize {
+		kb.replacements = kb.replacements[1:]
+	}
+}
+
+func (kb *KBucket) removeReplacement(n Node) {
+	for i, r := range kb.replacements {
+		if r.Equals(n) {
+			kb.replacements = append(kb.replacements[:i], kb.replacements[i+1:]...)
+			return
+		}
+	}
 }
 
 func (kb *KBucket) isTail(n Node) bool {
@@ -127,12 +248,15 @@ func (kb *KBucket) isUnderpopulated() bool {
 	return kb.Size <= Options.BucketCapacity/2
 }
 
-func (kb *KBucket) wasRecentlyUsed() bool {
-	return int(time.Since(kb.lastUsed).Seconds()) <= Options.TRefresh
+func (kb *KBucket) wasRecentlyUsed(now time.Time) bool {
+	return int(now.Sub(kb.lastUsed).Seconds()) <= Options.TRefresh
 }
 
-func (kb *KBucket) shouldBeRefreshed() bool {
-	return !kb.wasRecentlyUsed() || kb.isUnderpopulated()
+func (kb *KBucket) shouldBeRefreshed(now time.Time) bool {
+	kb.m.Lock()
+	defer kb.m.Unlock()
+
+	return !kb.wasRecentlyUsed(now) || kb.isUnderpopulated()
 }
 
 func (kb *KBucket) randomNum() *big.Int {
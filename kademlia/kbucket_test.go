@@ -1,7 +1,9 @@
 package kademlia
 
 import (
+	"math/big"
 	"testing"
+	"time"
 )
 
 func TestKBucket_Add(t *testing.T) {
@@ -10,7 +12,7 @@ func TestKBucket_Add(t *testing.T) {
 		nodes = append(nodes, NewNode("localhost", 8000+i, nil))
 	}
 
-	kb := KBucket{Owner: Node{}, Capacity: 11}
+	kb := KBucket{Owner: Node{}, Capacity: 11, clock: systemClock{}}
 	for _, node := range nodes {
 		kb.Add(node)
 	}
@@ -44,7 +46,7 @@ func TestKBucket_Remove(t *testing.T) {
 		nodes = append(nodes, NewNode("localhost", 8000+i, nil))
 	}
 
-	kb := KBucket{Owner: Node{}, Capacity: numNodes}
+	kb := KBucket{Owner: Node{}, Capacity: numNodes, clock: systemClock{}}
 	for _, node := range nodes {
 		kb.Add(node)
 	}
@@ -68,3 +70,90 @@ func TestKBucket_Remove(t *testing.T) {
 		t.Errorf("Bucket size should have been decreased by 3")
 	}
 }
+
+func TestKBucket_Evict(t *testing.T) {
+	var nodes []Node
+	numNodes := 5
+	for i := 0; i < numNodes; i++ {
+		nodes = append(nodes, NewNode("localhost", 8000+i, nil))
+	}
+
+	kb := KBucket{Owner: Node{}, Capacity: 3, clock: systemClock{}}
+	for _, node := range nodes[:3] {
+		kb.Add(node)
+	}
+
+	stale, ok := kb.Add(nodes[3])
+	if !ok || !stale.Equals(nodes[0]) {
+		t.Errorf("Adding to a full bucket should return the least-recently seen node")
+	}
+	if _, ok := kb.Add(nodes[4]); ok {
+		t.Errorf("Only one ping should be outstanding per bucket")
+	}
+	if len(kb.Replacements()) != 2 || kb.contains(nodes[3]) {
+		t.Errorf("Nodes added to a full bucket should be kept as replacements")
+	}
+
+	kb.Evict(nodes[0])
+	if kb.contains(nodes[0]) || !kb.isTail(nodes[4]) {
+		t.Errorf("An evicted node should be replaced by the most recent replacement")
+	}
+	if kb.Size != 3 || len(kb.Replacements()) != 1 {
+		t.Errorf("Eviction should keep the bucket full while replacements remain")
+	}
+
+	stale, ok = kb.Add(NewNode("localhost", 9000, nil))
+	if !ok || !stale.Equals(nodes[1]) {
+		t.Errorf("A new ping should be requested once the previous one is resolved")
+	}
+	kb.Responded(nodes[1])
+	if !kb.isTail(nodes[1]) || !kb.isHead(nodes[2]) {
+		t.Errorf("A responsive node should be moved to the tail")
+	}
+}
+
+func TestKBucket_Failed(t *testing.T) {
+	var nodes []Node
+	for i := 0; i < 4; i++ {
+		nodes = append(nodes, NewNode("localhost", 8000+i, nil))
+	}
+
+	kb := KBucket{Owner: Node{}, Capacity: 3, clock: systemClock{}}
+	for _, node := range nodes[:3] {
+		kb.Add(node)
+	}
+	for i := 1; i < Options.MaxFailures; i++ {
+		if kb.Failed(nodes[1]) {
+			t.Fatalf("A contact should survive %d failures without a replacement", i)
+		}
+	}
+	kb.Add(nodes[1])
+	if kb.Failed(nodes[1]) {
+		t.Errorf("Hearing from a contact should reset its failure count")
+	}
+	for i := 1; i < Options.MaxFailures; i++ {
+		kb.Failed(nodes[1])
+	}
+	if kb.contains(nodes[1]) {
+		t.Errorf("A contact should be evicted after %d consecutive failures", Options.MaxFailures)
+	}
+
+	kb.Add(nodes[1])
+	kb.Add(nodes[3])
+	if !kb.Failed(nodes[2]) || kb.contains(nodes[2]) || !kb.contains(nodes[3]) {
+		t.Errorf("A failed contact should be replaced at once when a replacement is waiting")
+	}
+}
+
+func TestKBucket_UsesClock(t *testing.T) {
+	clock := newFakeClock()
+	kb := NewKBucket(Node{}, "", clock)
+	clock.Advance(2 * time.Duration(Options.TRefresh) * time.Second)
+	if kb.wasRecentlyUsed(clock.Now()) {
+		t.Errorf("A bucket unused for longer than TRefresh should not count as recently used")
+	}
+	kb.Add(NewNode("localhost", 8000, big.NewInt(1)))
+	if !kb.wasRecentlyUsed(clock.Now()) {
+		t.Errorf("Adding a contact should mark the bucket as used at the clock's time")
+	}
+}
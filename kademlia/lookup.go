@@ -1,19 +1,53 @@
 package kademlia
 
 import (
-	"container/heap"
+	"context"
+	"crypto/ed25519"
+	"go-dht/bsonrpc"
 	"log"
 	"math/big"
+	"sort"
 	"sync"
+	"time"
 )
 
+// LookupResult describes a finished lookup: the k closest nodes that
+// responded, and how much work it took to find them.
+type LookupResult struct {
+	Closest  []Node
+	Rounds   int
+	RPCs     int
+	Failures int
+	Value    any
+	Found    bool
+}
+
 type Lookup struct {
 	initiator Server
 	key       *big.Int
+	valueKey  string
+	findValue bool
 	shortlist *Shortlist
 	m         sync.Mutex
-	rounds    int
-	value     any
+	result    LookupResult
+
+	// done receives every query once it completes, and slow the nodes whose
+	// queries outlast the soft timeout. queries and inflight track the
+	// queries still running and are only used by the goroutine running
+	// Execute, which never has more than cap(done) of them in flight.
+	done     chan *bsonrpc.PendingCall
+	slow     chan Node
+	queries  map[*bsonrpc.PendingCall]*pendingQuery
+	inflight int
+}
+
+// pendingQuery is a query sent with Client.GoContext that has yet to be
+// received from Lookup.done.
+type pendingQuery struct {
+	node   Node
+	key    ed25519.PublicKey
+	cancel context.CancelFunc
+	timer  *time.Timer
 }
 
 func NewLookup(initiator Server, key *big.Int) *Lookup {
@@ -21,61 +55,231 @@ func NewLookup(initiator Server, key *big.Int) *Lookup {
 		initiator: initiator,
 		key:       key,
 		shortlist: NewShortlist(key),
+		done:      make(chan *bsonrpc.PendingCall, 2*Options.BucketCapacity),
+		slow:      make(chan Node),
+		queries:   make(map[*bsonrpc.PendingCall]*pendingQuery),
 	}
 }
 
+// NewValueLookup creates a lookup that sends FIND_VALUE instead of FIND_NODE
+// and stops as soon as one of the queried nodes returns the value for key.
+func NewValueLookup(initiator Server, key string) *Lookup {
+	lu := NewLookup(initiator, keyId(key))
+	lu.valueKey = key
+	lu.findValue = true
+	return lu
+}
+
+func (lu *Lookup) Value() (any, bool) {
+	lu.m.Lock()
+	defer lu.m.Unlock()
+	return lu.result.Value, lu.result.Found
+}
+
+// mark records that n responded. The RPC that reached it has already added
+// it to the routing table, with the public key its reply was signed with.
 func (lu *Lookup) mark(n Node) {
+	lu.shortlist.MarkResponded(n)
+}
+
+func (lu *Lookup) record(val any) {
 	lu.m.Lock()
-	lu.shortlist.queriedNodes.Add(n)
-	lu.initiator.updateRoutingTable(n)
-	lu.m.Unlock()
+	defer lu.m.Unlock()
+	if val != nil && !lu.result.Found {
+		lu.result.Value = val
+		lu.result.Found = true
+	}
 }
 
-func (lu *Lookup) hasBeenQueried(n Node) bool {
+func (lu *Lookup) count(rpcs, failures int) {
 	lu.m.Lock()
 	defer lu.m.Unlock()
-	return lu.shortlist.queriedNodes.Has(n)
+	lu.result.RPCs += rpcs
+	lu.result.Failures += failures
 }
 
-func (lu *Lookup) Execute() []Node {
-	initNodes := lu.initiator.routingTable.GetNearest(lu.key)
+// Execute runs the lookup until the k closest nodes that have not failed
+// have all been queried and have responded. Rounds send alpha requests; once
+// a round brings no node closer than the closest one already known, the next
+// round queries every remaining unqueried node among the k closest. A round
+// does not wait for nodes slower than the soft timeout, whose replies are
+// taken into account by whichever round they arrive in. The shortlist is
+// seeded with every contact in the routing table so that a lookup whose
+// nearest contacts are down still has others to fall back on; only the k
+// closest of them are queried unless some fail.
+func (lu *Lookup) Execute(ctx context.Context) (*LookupResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	initNodes := lu.initiator.routingTable.GetNearestN(lu.key, -1)
 	lu.shortlist.Insert(initNodes...)
-	numSeenNodes := lu.shortlist.Len()
 
-	for {
-		lu.sendRequests(lu.shortlist.GetNextAlpha())
-		numNewNodes := lu.shortlist.Len() - numSeenNodes
-		if numNewNodes == 0 || lu.rounds == Options.MaxIterations {
+	width := Options.Alpha
+	for rounds := 0; rounds < Options.MaxIterations && !lu.shortlist.Done(); rounds++ {
+		closest := lu.shortlist.ClosestDistance()
+		nodes := lu.shortlist.Take(min(width, cap(lu.done)-lu.inflight))
+		if len(nodes) == 0 && lu.inflight == 0 {
+			break
+		}
+		err := lu.sendRequests(ctx, nodes)
+		if err != nil {
+			return nil, err
+		}
+		lu.m.Lock()
+		lu.result.Rounds++
+		lu.m.Unlock()
+		if _, found := lu.Value(); found {
 			break
 		}
-		numSeenNodes = lu.shortlist.Len()
-		lu.rounds++
+		width = Options.Alpha
+		if !lu.shortlist.Improved(closest) {
+			width = Options.BucketCapacity
+		}
 	}
 
-	return lu.shortlist.Closest()
+	lu.m.Lock()
+	defer lu.m.Unlock()
+	result := lu.result
+	result.Closest = lu.shortlist.Closest()
+	return &result, nil
+}
+
+type queryResult struct {
+	node  Node
+	value any
+	nodes []Node
+	err   error
 }
 
-func (lu *Lookup) sendRequests(nodes []Node) {
-	m, wg := sync.Mutex{}, sync.WaitGroup{}
+// softTimeout is how long a query may go unanswered before the lookup stops
+// waiting for it and queries the next candidate alongside it. It is well
+// below the RPC timeout, so that a slow peer delays the lookup by little more
+// than the soft timeout; its reply is still used if it arrives in time.
+func (lu *Lookup) softTimeout() time.Duration {
+	return lu.initiator.rpcTimeout / 4
+}
+
+// sendRequests queries nodes in parallel and waits until each of them has
+// answered or failed or is slower than the soft timeout. A node that fails or
+// is slow is replaced by the next unqueried candidate, and the queries of
+// slow nodes keep running: their replies are handled by later calls. If
+// nodes is empty, sendRequests waits for the next of those replies instead.
+func (lu *Lookup) sendRequests(ctx context.Context, nodes []Node) error {
+	waiting := &NodeSet{}
+	var send func(n Node)
+	replace := func() {
+		if next := lu.shortlist.Take(min(1, cap(lu.done)-lu.inflight)); len(next) > 0 {
+			send(next[0])
+		}
+	}
+	fail := func(n Node, err error, wasWaiting bool) {
+		log.Println(err)
+		lu.count(0, 1)
+		lu.shortlist.MarkFailed(n)
+		lu.initiator.routingTable.Failed(n)
+		if wasWaiting {
+			replace()
+		}
+	}
+	send = func(n Node) {
+		lu.count(1, 0)
+		if err := lu.query(ctx, n); err != nil {
+			fail(n, err, true)
+			return
+		}
+		waiting.Add(n)
+		lu.inflight++
+	}
 	for _, n := range nodes {
-		wg.Add(1)
-		go func(n Node) {
-			defer wg.Done()
-			if !lu.hasBeenQueried(n) {
-				list, err := lu.initiator.sendFindNode(lu.key.Text(16), n)
-				if err != nil {
-					log.Println(err)
-					lu.shortlist.Remove(n)
-					return
-				}
-				m.Lock()
-				lu.mark(n)
-				lu.shortlist.Insert(list...)
-				m.Unlock()
+		send(n)
+	}
+
+	received := false
+	for len(*waiting) > 0 || (len(nodes) == 0 && !received && lu.inflight > 0) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-lu.slow:
+			if waiting.Has(n) {
+				waiting.Remove(n)
+				lu.shortlist.MarkSlow(n)
+				replace()
+			}
+		case call := <-lu.done:
+			lu.inflight--
+			received = true
+			r := lu.complete(call)
+			wasWaiting := waiting.Has(r.node)
+			waiting.Remove(r.node)
+			if r.err != nil {
+				fail(r.node, r.err, wasWaiting)
+				continue
+			}
+			lu.mark(r.node)
+			lu.record(r.value)
+			lu.shortlist.Insert(r.nodes...)
+			if _, found := lu.Value(); found {
+				return nil
 			}
-		}(n)
+		}
+	}
+	return nil
+}
+
+// query sends n the lookup's request with Client.GoContext, to be received
+// from lu.done once it completes, and reports n on lu.slow if the soft
+// timeout passes first.
+func (lu *Lookup) query(ctx context.Context, n Node) error {
+	s := lu.initiator
+	client, err := s.ContactNode(n)
+	if err != nil {
+		return err
+	}
+	args := Args{Sender: s.Node, Key: lu.key.Text(16)}
+	method, reply := "Server.FindNode", any(&NodeResults{})
+	if lu.findValue {
+		args.Key = lu.valueKey
+		method, reply = "Server.FindValue", &Response{}
 	}
-	wg.Wait()
+
+	q := &pendingQuery{node: n}
+	callCtx, cancel := context.WithTimeout(ctx, s.rpcTimeout)
+	q.cancel = cancel
+	q.timer = time.AfterFunc(lu.softTimeout(), func() {
+		select {
+		case lu.slow <- n:
+		case <-ctx.Done():
+		}
+	})
+	call := client.GoContext(expectSigner(callCtx, n, &q.key), method, args, reply, lu.done)
+	lu.queries[call] = q
+	return nil
+}
+
+// complete turns a query received from lu.done into its result, adding the
+// node that answered to the routing table.
+func (lu *Lookup) complete(call *bsonrpc.PendingCall) queryResult {
+	q := lu.queries[call]
+	delete(lu.queries, call)
+	q.timer.Stop()
+	q.cancel()
+
+	r := queryResult{node: q.node, err: call.Error}
+	if r.err != nil {
+		return r
+	}
+	n := q.node
+	n.PublicKey = q.key
+	lu.initiator.updateRoutingTable(n)
+	switch reply := call.Reply.(type) {
+	case *NodeResults:
+		r.nodes = reply.Nodes
+	case *Response:
+		r.value, r.nodes, r.err = findValueReply(n, reply)
+	}
+	return r
 }
 
 type NodeSet map[string]bool
@@ -95,89 +299,171 @@ func (ns *NodeSet) Has(n Node) bool {
 	return ok
 }
 
+// Shortlist keeps every node seen during a lookup ordered by distance to the
+// key, together with whether it has been queried, has responded, has failed
+// or is slow. Failed nodes are never queried again nor returned as closest.
+// Slow nodes have yet to answer; they make way for the next candidates but
+// still have to respond or fail before the lookup is done.
 type Shortlist struct {
-	key          *big.Int
-	m            sync.Mutex
-	heap         *NodeHeap
-	queriedNodes *NodeSet
-	seenNodes    *NodeSet
-	candidates   []Node
-	index        int
+	key            *big.Int
+	m              sync.Mutex
+	nodes          []Node
+	seenNodes      *NodeSet
+	queriedNodes   *NodeSet
+	respondedNodes *NodeSet
+	failedNodes    *NodeSet
+	slowNodes      *NodeSet
 }
 
 func NewShortlist(key *big.Int) *Shortlist {
 	return &Shortlist{
-		key:          key,
-		heap:         &NodeHeap{Key: key},
-		seenNodes:    &NodeSet{},
-		queriedNodes: &NodeSet{},
-		candidates:   []Node{},
-		index:        0,
+		key:            key,
+		seenNodes:      &NodeSet{},
+		queriedNodes:   &NodeSet{},
+		respondedNodes: &NodeSet{},
+		failedNodes:    &NodeSet{},
+		slowNodes:      &NodeSet{},
 	}
 }
 
+func (sl *Shortlist) distance(n Node) *big.Int {
+	return new(big.Int).Xor(sl.key, n.Id)
+}
+
 func (sl *Shortlist) Insert(node ...Node) {
 	sl.m.Lock()
 	defer sl.m.Unlock()
 
 	for _, n := range node {
-		if !sl.seenNodes.Has(n) {
-			sl.seenNodes.Add(n)
-			heap.Push(sl.heap, n)
-			sl.candidates = append(sl.candidates, n)
+		if sl.seenNodes.Has(n) {
+			continue
 		}
+		sl.seenNodes.Add(n)
+		dist := sl.distance(n)
+		i := sort.Search(len(sl.nodes), func(i int) bool {
+			return sl.distance(sl.nodes[i]).Cmp(dist) > 0
+		})
+		sl.nodes = append(sl.nodes, Node{})
+		copy(sl.nodes[i+1:], sl.nodes[i:])
+		sl.nodes[i] = n
 	}
 }
 
-func (sl *Shortlist) Remove(node Node) {
+func (sl *Shortlist) MarkResponded(n Node) {
+	sl.m.Lock()
+	defer sl.m.Unlock()
+
+	sl.respondedNodes.Add(n)
+}
+
+func (sl *Shortlist) MarkFailed(n Node) {
+	sl.m.Lock()
+	defer sl.m.Unlock()
+
+	sl.failedNodes.Add(n)
+}
+
+// MarkSlow records that n has not answered within the soft timeout.
+func (sl *Shortlist) MarkSlow(n Node) {
 	sl.m.Lock()
 	defer sl.m.Unlock()
 
-	sl.seenNodes.Remove(node)
-	sl.queriedNodes.Remove(node)
+	sl.slowNodes.Add(n)
 }
 
-func (sl *Shortlist) GetNextAlpha() []Node {
+func (sl *Shortlist) HasBeenQueried(n Node) bool {
 	sl.m.Lock()
 	defer sl.m.Unlock()
 
+	return sl.queriedNodes.Has(n)
+}
+
+// closest returns up to k nodes, closest first, that have not failed and,
+// unless withSlow is set, that are not slow.
+func (sl *Shortlist) closest(withSlow bool) []Node {
 	var nodes []Node
-	end := sl.index + Options.Alpha
-	for i := sl.index; sl.index < len(sl.candidates) && i < end; i++ {
-		if !sl.queriedNodes.Has(sl.candidates[i]) {
-			nodes = append(nodes, sl.candidates[i])
-			sl.index++
+	for _, n := range sl.nodes {
+		if len(nodes) == Options.BucketCapacity {
+			break
+		}
+		if !sl.failedNodes.Has(n) && (withSlow || !sl.slowNodes.Has(n) || sl.respondedNodes.Has(n)) {
+			nodes = append(nodes, n)
 		}
 	}
+	return nodes
+}
+
+// Take marks and returns up to count unqueried nodes from the k closest that
+// are not slow.
+func (sl *Shortlist) Take(count int) []Node {
+	sl.m.Lock()
+	defer sl.m.Unlock()
 
+	var nodes []Node
+	for _, n := range sl.closest(false) {
+		if len(nodes) == count {
+			break
+		}
+		if !sl.queriedNodes.Has(n) {
+			sl.queriedNodes.Add(n)
+			nodes = append(nodes, n)
+		}
+	}
 	return nodes
 }
 
-func (sl *Shortlist) Closest() []Node {
+// Done reports whether every one of the k closest nodes has responded.
+func (sl *Shortlist) Done() bool {
 	sl.m.Lock()
 	defer sl.m.Unlock()
 
-	var closestNodes []Node
-	for i := 0; len(sl.heap.Nodes) > 0 && i < Options.BucketCapacity; i++ {
-		n := heap.Pop(sl.heap).(Node)
-		if sl.seenNodes.Has(n) {
-			closestNodes = append(closestNodes, n)
+	for _, n := range sl.closest(true) {
+		if !sl.respondedNodes.Has(n) {
+			return false
 		}
 	}
+	return true
+}
+
+// ClosestDistance returns the distance from the key to the closest node that
+// has not failed, or nil if there is none.
+func (sl *Shortlist) ClosestDistance() *big.Int {
+	sl.m.Lock()
+	defer sl.m.Unlock()
 
-	return closestNodes
+	closest := sl.closest(true)
+	if len(closest) == 0 {
+		return nil
+	}
+	return sl.distance(closest[0])
 }
 
-func (sl *Shortlist) Len() int {
+// Improved reports whether a node closer than dist has been seen.
+func (sl *Shortlist) Improved(dist *big.Int) bool {
+	closest := sl.ClosestDistance()
+	return closest != nil && (dist == nil || closest.Cmp(dist) < 0)
+}
+
+// Closest returns up to k closest nodes that have responded.
+func (sl *Shortlist) Closest() []Node {
 	sl.m.Lock()
 	defer sl.m.Unlock()
 
-	return len(*sl.seenNodes)
+	var nodes []Node
+	for _, n := range sl.nodes {
+		if len(nodes) == Options.BucketCapacity {
+			break
+		}
+		if sl.respondedNodes.Has(n) {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
 }
 
-func (sl *Shortlist) Pop() Node {
+func (sl *Shortlist) Len() int {
 	sl.m.Lock()
 	defer sl.m.Unlock()
 
-	return heap.Pop(sl.heap).(Node)
+	return len(*sl.seenNodes)
 }
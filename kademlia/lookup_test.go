@@ -0,0 +1,76 @@
+package kademlia
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestShortlist_Done(t *testing.T) {
+	var nodes []Node
+	for i := 1; i <= Options.BucketCapacity+2; i++ {
+		nodes = append(nodes, NewNode("localhost", 8000+i, big.NewInt(int64(i))))
+	}
+
+	sl := NewShortlist(big.NewInt(0))
+	sl.Insert(nodes[len(nodes)-1])
+	sl.Insert(nodes[:len(nodes)-1]...)
+
+	taken := sl.Take(len(nodes))
+	if len(taken) != Options.BucketCapacity || !taken[0].Equals(nodes[0]) {
+		t.Errorf("Only the k closest nodes should be queried, closest first")
+	}
+
+	sl.MarkFailed(nodes[0])
+	for _, n := range taken[1:] {
+		sl.MarkResponded(n)
+	}
+	if sl.Done() {
+		t.Errorf("Lookup should not be done while a node among the k closest is unqueried")
+	}
+
+	next := sl.Take(1)
+	if len(next) != 1 || !next[0].Equals(nodes[Options.BucketCapacity]) {
+		t.Errorf("A failed node should be replaced by the next closest node")
+	}
+	sl.MarkResponded(next[0])
+	if !sl.Done() {
+		t.Errorf("Lookup should be done once the k closest non-failed nodes responded")
+	}
+	for _, n := range sl.Closest() {
+		if n.Equals(nodes[0]) {
+			t.Errorf("Failed nodes should not be returned as closest")
+		}
+	}
+}
+
+func TestShortlist_SlowNodes(t *testing.T) {
+	var nodes []Node
+	for i := 1; i <= Options.BucketCapacity+1; i++ {
+		nodes = append(nodes, NewNode("localhost", 8000+i, big.NewInt(int64(i))))
+	}
+
+	sl := NewShortlist(big.NewInt(0))
+	sl.Insert(nodes...)
+	taken := sl.Take(Options.BucketCapacity)
+	for _, n := range taken[1:] {
+		sl.MarkResponded(n)
+	}
+
+	sl.MarkSlow(nodes[0])
+	next := sl.Take(1)
+	if len(next) != 1 || !next[0].Equals(nodes[Options.BucketCapacity]) {
+		t.Fatalf("A slow node should make way for the next closest node, got %v", next)
+	}
+	sl.MarkResponded(next[0])
+	if sl.Done() {
+		t.Errorf("Lookup should wait for a slow node among the k closest")
+	}
+
+	sl.MarkResponded(nodes[0])
+	if !sl.Done() {
+		t.Errorf("Lookup should be done once the slow node responded")
+	}
+	if closest := sl.Closest(); len(closest) == 0 || !closest[0].Equals(nodes[0]) {
+		t.Errorf("The late reply of a slow node should be kept, got %v", closest)
+	}
+}
@@ -0,0 +1,121 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Schedule sets how often each maintenance task runs once a Server has been
+// started. A zero interval disables the task. IdleConns is how often pooled
+// connections unused for Options.ConnIdleTimeout are closed, and
+// RoutingTable how often the routing table is saved if the server was given
+// a file for it, so that a crash loses no more than that much of it.
+type Schedule struct {
+	Refresh      time.Duration
+	Replicate    time.Duration
+	Republish    time.Duration
+	Expire       time.Duration
+	IdleConns    time.Duration
+	RoutingTable time.Duration
+}
+
+func DefaultSchedule() Schedule {
+	return Schedule{
+		Refresh:      time.Duration(Options.TRefresh) * time.Second,
+		Replicate:    time.Minute,
+		Republish:    time.Minute,
+		Expire:       time.Minute,
+		IdleConns:    Options.ConnIdleTimeout,
+		RoutingTable: 5 * time.Minute,
+	}
+}
+
+// lifecycle holds the current run of a server's maintenance tasks, if any.
+// stopped is closed once the run has ended and its tasks have returned.
+type lifecycle struct {
+	m       sync.Mutex
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// Start runs the refresh, replicate, republish and expire tasks in the
+// background according to the server's schedule until ctx is cancelled or
+// Stop is called. If the server was given a file for its routing table, the
+// table is saved on schedule and once more after the tasks have returned,
+// after which the server can be started again.
+func (s Server) Start(ctx context.Context) error {
+	s.lifecycle.m.Lock()
+	defer s.lifecycle.m.Unlock()
+
+	if s.lifecycle.cancel != nil {
+		return errors.New("server already started")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	s.lifecycle.cancel, s.lifecycle.stopped = cancel, stopped
+
+	var wg sync.WaitGroup
+	s.every(ctx, &wg, s.schedule.Refresh, s.Refresh)
+	s.every(ctx, &wg, s.schedule.Replicate, s.Replicate)
+	s.every(ctx, &wg, s.schedule.Republish, s.Republish)
+	s.every(ctx, &wg, s.schedule.Expire, func(context.Context) { s.Expire() })
+	s.every(ctx, &wg, s.schedule.IdleConns, func(context.Context) { s.pool.CloseIdle(Options.ConnIdleTimeout) })
+	if s.routingTableFile != "" {
+		s.every(ctx, &wg, s.schedule.RoutingTable, func(context.Context) { s.saveRoutingTable() })
+	}
+	if len(s.restored) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.revalidate(ctx, s.restored)
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		wg.Wait()
+		s.saveRoutingTable()
+
+		s.lifecycle.m.Lock()
+		if s.lifecycle.stopped == stopped {
+			s.lifecycle.cancel, s.lifecycle.stopped = nil, nil
+		}
+		s.lifecycle.m.Unlock()
+		cancel()
+		close(stopped)
+	}()
+	return nil
+}
+
+// Stop cancels the maintenance tasks and waits for running ones to return
+// and for the routing table to be saved.
+func (s Server) Stop() {
+	s.lifecycle.m.Lock()
+	cancel, stopped := s.lifecycle.cancel, s.lifecycle.stopped
+	s.lifecycle.m.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-stopped
+}
+
+func (s Server) every(ctx context.Context, wg *sync.WaitGroup, interval time.Duration, task func(context.Context)) {
+	if interval <= 0 {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.clock.After(interval):
+				task(ctx)
+			}
+		}
+	}()
+}
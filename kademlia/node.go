@@ -1,23 +1,33 @@
 package kademlia
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"go-dht/bson"
+	"go-dht/bsonrpc"
 	"go-dht/pkg/util"
 	"math/big"
 	"strconv"
 )
 
+// Node is a contact in the network. Transports lists the bsonrpc networks
+// it accepts requests on; a node that advertises none is reached over UDP.
+// PublicKey is the key the node signs its messages with, from which its ID
+// is derived.
 type Node struct {
-	Id   *big.Int
-	Host string
-	Port int
+	Id         *big.Int
+	Host       string
+	Port       int
+	Transports []string
+	PublicKey  ed25519.PublicKey
 }
 
 type Contact struct {
-	Id   string
-	Host string
-	Port int
+	Id         string
+	Host       string
+	Port       int
+	Transports []string
+	PublicKey  []byte
 }
 
 func NewNode(host string, port int, id *big.Int) Node {
@@ -30,9 +40,13 @@ func NewNode(host string, port int, id *big.Int) Node {
 
 func (n Node) MarshalBSON() ([]byte, error) {
 	m := bson.M{
-		"Id":   n.Id.Text(16),
-		"Host": n.Host,
-		"Port": n.Port,
+		"Id":         n.Id.Text(16),
+		"Host":       n.Host,
+		"Port":       n.Port,
+		"Transports": n.Transports,
+	}
+	if n.PublicKey != nil {
+		m["PublicKey"] = []byte(n.PublicKey)
 	}
 	data, err := bson.Marshal(m)
 	if err != nil {
@@ -49,6 +63,10 @@ func (n *Node) UnmarshalBSON(data []byte) error {
 	}
 	n.Host = contact.Host
 	n.Port = contact.Port
+	n.Transports = contact.Transports
+	if len(contact.PublicKey) > 0 {
+		n.PublicKey = contact.PublicKey
+	}
 	id, ok := new(big.Int).SetString(contact.Id, 16)
 	if !ok {
 		return fmt.Errorf("invalid id %s", contact.Id)
@@ -57,6 +75,16 @@ func (n *Node) UnmarshalBSON(data []byte) error {
 	return nil
 }
 
+// Supports reports whether the node accepts requests on network.
+func (n Node) Supports(network string) bool {
+	for _, t := range n.Transports {
+		if t == network {
+			return true
+		}
+	}
+	return network == bsonrpc.UDP && len(n.Transports) == 0
+}
+
 func (n Node) String() string {
 	return fmt.Sprintf("(%s:%d %s)", n.Host, n.Port, n.Id.Text(16))
 }
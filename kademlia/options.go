@@ -1,17 +1,95 @@
 package kademlia
 
+import (
+	"go-dht/bsonrpc"
+	"time"
+)
+
 type KadOptions struct {
-	BucketCapacity int
-	Alpha          int
-	TRefresh       int
-	TExpiration    int
-	MaxIterations  int
+	BucketCapacity       int
+	ReplacementCacheSize int
+	Alpha                int
+	TRefresh             int
+	TExpiration          int
+	TReplicate           int
+	TRepublish           int
+	MaxIterations        int
+	MaxFailures          int
+	RPCTimeout           time.Duration
+	ConnIdleTimeout      time.Duration
 }
 
+// Options holds the protocol parameters, with times in seconds. TExpiration
+// must exceed TRepublish plus the period of the republish task by a wide
+// margin, or stored values lapse on other nodes before they are renewed.
 var Options = KadOptions{
-	BucketCapacity: 3,
-	Alpha:          3,
-	TRefresh:       60 * 60,
-	TExpiration:    60 * 60,
-	MaxIterations:  20,
+	BucketCapacity:       3,
+	ReplacementCacheSize: 3,
+	Alpha:                3,
+	TRefresh:             60 * 60,
+	TExpiration:          24 * 60 * 60,
+	TReplicate:           60 * 60,
+	TRepublish:           60 * 60,
+	MaxIterations:        20,
+	MaxFailures:          5,
+	RPCTimeout:           2 * time.Second,
+	ConnIdleTimeout:      time.Minute,
+}
+
+type ServerOption func(*Server)
+
+func WithClock(clock Clock) ServerOption {
+	return func(s *Server) {
+		s.clock = clock
+	}
+}
+
+func WithSchedule(schedule Schedule) ServerOption {
+	return func(s *Server) {
+		s.schedule = schedule
+	}
+}
+
+// WithStore replaces the default in-memory store.
+func WithStore(store Store) ServerOption {
+	return func(s *Server) {
+		s.dataStore = store
+	}
+}
+
+// WithRPCTimeout bounds how long the server waits for each reply, in place
+// of Options.RPCTimeout.
+func WithRPCTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.rpcTimeout = d
+	}
+}
+
+// WithRoutingTableFile loads the contacts saved at path when the server is
+// created and saves the routing table there when it is stopped. Only a table
+// saved by a server with the same ID is loaded, so the server should also be
+// given its identity. Restored contacts are only added to the routing table
+// once they answer a ping, which happens in the background after Start.
+func WithRoutingTableFile(path string) ServerOption {
+	return func(s *Server) {
+		s.routingTableFile = path
+	}
+}
+
+// WithTCP makes the server accept requests over TCP as well as UDP and
+// advertise both. Requests to peers that also advertise TCP are then sent
+// over a pooled TCP connection.
+func WithTCP() ServerOption {
+	return func(s *Server) {
+		s.rpcOptions = append(s.rpcOptions, bsonrpc.WithTCP())
+	}
+}
+
+// WithNetwork makes the server listen on and contact its peers through nw,
+// such as a simulated network, instead of real UDP sockets.
+func WithNetwork(nw bsonrpc.Network) ServerOption {
+	return func(s *Server) {
+		s.rpcOptions = append(s.rpcOptions, bsonrpc.WithNetwork(nw))
+		s.dialOptions = append(s.dialOptions, bsonrpc.WithClientNetwork(nw))
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"container/heap"
 	"math/big"
 	"strings"
+	"sync"
 )
 
 type RTNode struct {
@@ -13,16 +14,18 @@ type RTNode struct {
 	K       int
 	Prefix  string
 	RtOwner Node
+	clock   Clock
 }
 
-func NewRTNode(owner Node) *RTNode {
+func NewRTNode(owner Node, clock Clock) *RTNode {
 	return &RTNode{
-		Bucket:  NewKBucket(owner, ""),
+		Bucket:  NewKBucket(owner, "", clock),
 		Left:    nil,
 		Right:   nil,
 		K:       Options.BucketCapacity,
 		Prefix:  "",
 		RtOwner: owner,
+		clock:   clock,
 	}
 }
 
@@ -53,7 +56,7 @@ func (rn *RTNode) String() string {
 
 func (rn *RTNode) Split(prefixes map[string]*KBucket) {
 	prfx := rn.Prefix
-	zeroBucket, oneBucket := NewKBucket(rn.RtOwner, prfx+"0"), NewKBucket(rn.RtOwner, prfx+"1")
+	zeroBucket, oneBucket := NewKBucket(rn.RtOwner, prfx+"0", rn.clock), NewKBucket(rn.RtOwner, prfx+"1", rn.clock)
 	ptr, pLen := rn.Bucket.Tail, len(prfx)
 	for ptr != nil {
 		currId := ptr.Data.Id
@@ -65,10 +68,17 @@ func (rn *RTNode) Split(prefixes map[string]*KBucket) {
 		}
 		ptr = ptr.Prev
 	}
+	for _, n := range rn.Bucket.replacements {
+		if n.Id.Bit(159-pLen) == 0 {
+			zeroBucket.addReplacement(n)
+		} else {
+			oneBucket.addReplacement(n)
+		}
+	}
 	rn.Bucket = nil
 	delete(prefixes, prfx)
-	rn.Left = &RTNode{RtOwner: rn.RtOwner, Bucket: zeroBucket, K: Options.BucketCapacity, Prefix: prfx + "0"}
-	rn.Right = &RTNode{RtOwner: rn.RtOwner, Bucket: oneBucket, K: Options.BucketCapacity, Prefix: prfx + "1"}
+	rn.Left = &RTNode{RtOwner: rn.RtOwner, Bucket: zeroBucket, K: Options.BucketCapacity, Prefix: prfx + "0", clock: rn.clock}
+	rn.Right = &RTNode{RtOwner: rn.RtOwner, Bucket: oneBucket, K: Options.BucketCapacity, Prefix: prfx + "1", clock: rn.clock}
 	prefixes[rn.Left.Prefix] = rn.Left.Bucket
 	prefixes[rn.Right.Prefix] = rn.Right.Bucket
 }
@@ -77,29 +87,38 @@ func (rn *RTNode) isLeaf() bool {
 	return rn.Left == nil && rn.Right == nil && rn.Bucket != nil
 }
 
-func (rn *RTNode) Add(currPos int, node Node, prefixes map[string]*KBucket) int {
+// Add inserts node into the subtree, splitting buckets on the owner's path as
+// needed. It returns the change in the number of contacts and, when node's
+// bucket is full, the least-recently seen contact that should be pinged.
+func (rn *RTNode) Add(currPos int, node Node, prefixes map[string]*KBucket) (int, *Node) {
 	if rn.isLeaf() {
+		if rn.Bucket.contains(node) {
+			rn.Bucket.Add(node)
+			return 0, nil
+		}
 		if rn.Bucket.Size < rn.K {
 			rn.Bucket.Add(node)
-			return 1
+			return 1, nil
 		}
 		prefix := rn.Bucket.Prefix
 		if prefix == rn.RtOwner.Prefix(len(prefix)) {
 			rn.Split(prefixes)
 			return rn.Add(currPos, node, prefixes)
 		}
-	} else {
-		bit := node.Id.Bit(159 - currPos)
-		if bit == 0 {
-			return rn.Left.Add(currPos+1, node, prefixes)
-		} else {
-			return rn.Right.Add(currPos+1, node, prefixes)
+		if stale, ok := rn.Bucket.Add(node); ok {
+			return 0, &stale
 		}
+		return 0, nil
+	}
+	bit := node.Id.Bit(159 - currPos)
+	if bit == 0 {
+		return rn.Left.Add(currPos+1, node, prefixes)
 	}
-	return 0
+	return rn.Right.Add(currPos+1, node, prefixes)
 }
 
 type RoutingTable struct {
+	m              sync.RWMutex
 	Owner          Node
 	K              int
 	Root           *RTNode
@@ -108,25 +127,106 @@ type RoutingTable struct {
 }
 
 func (rt *RoutingTable) String() string {
+	rt.m.RLock()
+	defer rt.m.RUnlock()
+
 	return rt.Root.String()
 }
 
-func NewRoutingTable(owner Node, k int) *RoutingTable {
+// NewRoutingTable returns a table holding only owner's empty bucket. Its
+// buckets tell when they were last used by clock.
+func NewRoutingTable(owner Node, k int, clock Clock) *RoutingTable {
 	rt := &RoutingTable{
 		Owner:          owner,
 		K:              k,
-		Root:           NewRTNode(owner),
+		Root:           NewRTNode(owner, clock),
 		BucketPrefixes: make(map[string]*KBucket),
 	}
 	rt.BucketPrefixes[""] = rt.Root.Bucket
 	return rt
 }
 
-func (rt *RoutingTable) Add(node Node) {
-	rt.Size += rt.Root.Add(0, node, rt.BucketPrefixes)
+// Add inserts node into the table. If the node's bucket is full, the node is
+// cached as a replacement and the bucket's least-recently seen contact is
+// returned; the caller should ping it and report back through Responded or
+// Remove.
+func (rt *RoutingTable) Add(node Node) (Node, bool) {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+
+	added, stale := rt.Root.Add(0, node, rt.BucketPrefixes)
+	rt.Size += added
+	if stale == nil {
+		return Node{}, false
+	}
+	return *stale, true
+}
+
+// Remove evicts node from its bucket, promoting a cached replacement.
+func (rt *RoutingTable) Remove(node Node) {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+
+	bucket := rt.bucketFor(node.Id)
+	size := bucket.Size
+	bucket.Evict(node)
+	rt.Size += bucket.Size - size
+}
+
+// Failed records that node did not answer an RPC, evicting it as described
+// for KBucket.Failed.
+func (rt *RoutingTable) Failed(node Node) {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+
+	bucket := rt.bucketFor(node.Id)
+	size := bucket.Size
+	bucket.Failed(node)
+	rt.Size += bucket.Size - size
+}
+
+func (rt *RoutingTable) Responded(node Node) {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+
+	rt.bucketFor(node.Id).Responded(node)
+}
+
+func (rt *RoutingTable) bucketFor(id *big.Int) *KBucket {
+	rn := rt.Root
+	for pos := 0; !rn.isLeaf(); pos++ {
+		if id.Bit(159-pos) == 0 {
+			rn = rn.Left
+		} else {
+			rn = rn.Right
+		}
+	}
+	return rn.Bucket
+}
+
+// Buckets returns a snapshot of the table's buckets keyed by prefix.
+func (rt *RoutingTable) Buckets() map[string]*KBucket {
+	rt.m.RLock()
+	defer rt.m.RUnlock()
+
+	buckets := make(map[string]*KBucket, len(rt.BucketPrefixes))
+	for prefix, bucket := range rt.BucketPrefixes {
+		buckets[prefix] = bucket
+	}
+	return buckets
 }
 
 func (rt *RoutingTable) GetNearest(key *big.Int) []Node {
+	return rt.GetNearestN(key, rt.K)
+}
+
+// GetNearestN returns up to count contacts, or all of them if count is
+// negative, ordered by distance to key and excluding the contact whose ID is
+// key itself.
+func (rt *RoutingTable) GetNearestN(key *big.Int, count int) []Node {
+	rt.m.RLock()
+	defer rt.m.RUnlock()
+
 	nodeHeap := &NodeHeap{Key: key}
 	heap.Init(nodeHeap)
 	for _, bucket := range rt.BucketPrefixes {
@@ -139,7 +239,7 @@ func (rt *RoutingTable) GetNearest(key *big.Int) []Node {
 		}
 	}
 	var nodes []Node
-	for i := 0; len(nodeHeap.Nodes) > 0 && i < rt.K; i++ {
+	for i := 0; len(nodeHeap.Nodes) > 0 && (count < 0 || i < count); i++ {
 		nodes = append(nodes, heap.Pop(nodeHeap).(Node))
 	}
 	return nodes
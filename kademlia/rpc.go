@@ -1,15 +1,23 @@
 package kademlia
 
 import (
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"go-dht/bsonrpc"
 	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Args struct {
 	Sender Node
 	Key    string
 	Data   any
+	TTL    int
 	RpcId  string
 }
 
@@ -17,18 +25,26 @@ type Response struct {
 	Message string
 	Code    uint8
 	Nodes   []Node
+	Found   bool
+	Value   any
+
+	Transports []string
 }
 
 type NodeResults struct {
 	Nodes []Node
 }
 
-func (s Server) SendPing(other Server) error {
-	if s.Id() == other.Id() {
+func (s Server) SendPing(ctx context.Context, other Node) error {
+	return s.sendPing(ctx, other)
+}
+
+func (s Server) sendPing(ctx context.Context, other Node) error {
+	if s.Id().Cmp(other.Id) == 0 {
 		return nil
 	}
 
-	client, err := s.Contact(other)
+	client, err := s.ContactNode(other)
 	if err != nil {
 		return err
 	}
@@ -36,12 +52,12 @@ func (s Server) SendPing(other Server) error {
 	args := Args{Sender: s.Node}
 
 	var resp Response
-	err = client.Call("Server.Ping", args, &resp)
+	other.PublicKey, err = s.call(ctx, client, other, "Server.Ping", args, &resp)
 	if err != nil {
 		return err
 	}
 
-	s.updateRoutingTable(other.Node)
+	s.updateRoutingTable(other)
 	//fmt.Println("PONG", resp)
 	return nil
 }
@@ -51,15 +67,63 @@ func (s Server) Ping(callArgs Args, response *Response) error {
 	//fmt.Printf("PING %s\n", sender)
 	s.updateRoutingTable(sender)
 	response.Message = s.Node.Id.Text(16)
+	response.Transports = s.Node.Transports
 	response.Code = 1
 	return nil
 }
 
-func (s Server) SendFindNode(key string, other Server) ([]Node, error) {
-	return s.sendFindNode(key, other.Node)
+// PingAddress pings the node listening at address, a "host:port" string,
+// learning its ID from the key its reply is signed with and adding it to the
+// routing table. Nodes are reached over UDP until they advertise TCP; an
+// address of the form "tcp://host:port" says up front that the node accepts
+// TCP, so that it is pinged over TCP if this server supports it too.
+func (s Server) PingAddress(ctx context.Context, address string) (Node, error) {
+	seed := Node{Transports: []string{bsonrpc.UDP}}
+	if network, rest, ok := strings.Cut(address, "://"); ok {
+		switch network {
+		case bsonrpc.UDP:
+		case bsonrpc.TCP:
+			seed.Transports = append(seed.Transports, bsonrpc.TCP)
+		default:
+			return Node{}, fmt.Errorf("unsupported network %q in address %s", network, address)
+		}
+		address = rest
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return Node{}, err
+	}
+	seed.Host = host
+	seed.Port, err = strconv.Atoi(portStr)
+	if err != nil {
+		return Node{}, fmt.Errorf("invalid port in address %s", address)
+	}
+
+	client, err := s.ContactNode(seed)
+	if err != nil {
+		return Node{}, err
+	}
+
+	args := Args{Sender: s.Node}
+
+	var resp Response
+	key, err := s.call(ctx, client, seed, "Server.Ping", args, &resp)
+	if err != nil {
+		return Node{}, err
+	}
+
+	n := NewNode(host, seed.Port, IdFromKey(key))
+	n.PublicKey = key
+	n.Transports = resp.Transports
+	s.updateRoutingTable(n)
+	return n, nil
 }
 
-func (s Server) sendFindNode(key string, other Node) ([]Node, error) {
+func (s Server) SendFindNode(ctx context.Context, key string, other Node) ([]Node, error) {
+	return s.sendFindNode(ctx, key, other)
+}
+
+func (s Server) sendFindNode(ctx context.Context, key string, other Node) ([]Node, error) {
 	client, err := s.ContactNode(other)
 	if err != nil {
 		return nil, err
@@ -71,7 +135,7 @@ func (s Server) sendFindNode(key string, other Node) ([]Node, error) {
 	}
 
 	var resp Response
-	err = client.Call("Server.FindNode", args, &resp)
+	other.PublicKey, err = s.call(ctx, client, other, "Server.FindNode", args, &resp)
 	if err != nil {
 		return nil, err
 	}
@@ -94,15 +158,15 @@ func (s Server) FindNode(args Args, response *NodeResults) error {
 	//response.Message = "S"
 	response.Nodes = s.routingTable.GetNearest(keyInt)
 	s.updateRoutingTable(args.Sender)
-	fmt.Println("got something", response.Nodes)
 	return nil
 }
 
-func (s Server) SendStore(key string, val any, other Server) error {
-	return s.sendStore(key, val, other.Node)
+func (s Server) SendStore(ctx context.Context, key string, val any, other Node) error {
+	return s.sendStore(ctx, key, val, time.Duration(Options.TExpiration)*time.Second, other)
 }
 
-func (s Server) sendStore(key string, val any, other Node) error {
+// sendStore asks other to store val under key for ttl.
+func (s Server) sendStore(ctx context.Context, key string, val any, ttl time.Duration, other Node) error {
 	client, err := s.ContactNode(other)
 	if err != nil {
 		return err
@@ -112,56 +176,126 @@ func (s Server) sendStore(key string, val any, other Node) error {
 		Sender: s.Node,
 		Key:    key,
 		Data:   val,
+		TTL:    ttlSeconds(ttl),
 	}
 
 	var resp Response
-	err = client.Call("Server.Store", args, &resp)
+	other.PublicKey, err = s.call(ctx, client, other, "Server.Store", args, &resp)
+	var rpcErr *bsonrpc.Error
+	if errors.As(err, &rpcErr) {
+		s.updateRoutingTable(other)
+		return fmt.Errorf("store on %s failed: %w", other, err)
+	}
 	if err != nil {
 		return err
 	}
 
 	s.updateRoutingTable(other)
-
-	fmt.Println(resp)
 	return nil
 }
 
+// storeBatchSize bounds how many values sendStores sends in one request.
+const storeBatchSize = 32
+
+// sendStores stores several records on other in a single batch request, each
+// for its remaining TTL, and returns the error for each of them in order.
+func (s Server) sendStores(ctx context.Context, records []Record, other Node) []error {
+	errs := make([]error, len(records))
+	client, err := s.ContactNode(other)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	now := s.clock.Now()
+	var batch bsonrpc.Batch
+	for _, r := range records {
+		args := Args{Sender: s.Node, Key: r.Key, Data: r.Value, TTL: ttlSeconds(r.RemainingTTL(now))}
+		batch.Add("Server.Store", args, &Response{})
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.rpcTimeout)
+	defer cancel()
+	err = client.CallBatch(expectSigner(ctx, other, &other.PublicKey), &batch)
+	var rpcErr *bsonrpc.Error
+	if err == nil || errors.As(err, &rpcErr) {
+		s.updateRoutingTable(other)
+	}
+	for i, call := range batch.Calls {
+		if call.Error != nil {
+			errs[i] = fmt.Errorf("store of %q on %s failed: %w", records[i].Key, other, call.Error)
+		}
+	}
+	return errs
+}
+
 func (s Server) Store(args Args, response *Response) error {
-	s.dataStore[args.Key] = args.Data
+	ttl := time.Duration(args.TTL) * time.Second
+	if args.TTL <= 0 {
+		ttl = time.Duration(Options.TExpiration) * time.Second
+	}
+	err := s.putRecord(args.Key, args.Data, ttl, false)
+	if err != nil {
+		return fmt.Errorf("could not store %s: %w", args.Key, err)
+	}
 	response.Code = 1
 	response.Message = "S"
 	s.updateRoutingTable(args.Sender)
 	return nil
 }
 
-func (s Server) FindValue(callArgs Args, response *Response) error {
-	key := callArgs.Key
-	keyInt, ok := new(big.Int).SetString(key, 16)
-	if !ok {
-		response.Code = 0
-		response.Message = "invalid key: " + key
-		return nil
+// findValueReply returns the value in a reply to FIND_VALUE from other, or
+// the contacts it returned instead.
+func findValueReply(other Node, resp *Response) (any, []Node, error) {
+	if resp.Code == 0 {
+		return nil, nil, fmt.Errorf("find value on %s failed: %s", other, resp.Message)
 	}
+	if resp.Found {
+		return resp.Value, nil, nil
+	}
+	return nil, resp.Nodes, nil
+}
+
+// FindValue returns the value stored under the key if this node holds it,
+// and the closest contacts to the key's hash otherwise.
+func (s Server) FindValue(args Args, response *Response) error {
+	s.updateRoutingTable(args.Sender)
 	response.Message = "S"
 	response.Code = 1
-	response.Nodes = s.routingTable.GetNearest(keyInt)
+	if r, ok := s.getRecord(args.Key); ok {
+		response.Found = true
+		response.Value = r.Value
+		return nil
+	}
+	response.Nodes = s.routingTable.GetNearest(keyId(args.Key))
 	return nil
 }
 
-func (s Server) Contact(other Server) (*bsonrpc.Client, error) {
-	client, err := bsonrpc.Dial(other.Node.Host, other.Node.Port)
-	if err != nil {
-		return nil, fmt.Errorf("error contacting (UDP) node at %s", other.Node)
-	}
-
-	return client, nil
+// call invokes method on other through client, bounding the wait for the
+// reply by the server's RPC timeout on top of any deadline ctx already
+// carries. The reply must be signed with the key behind other's ID, which is
+// returned.
+func (s Server) call(ctx context.Context, client *bsonrpc.Client, other Node, method string, args Args, reply any) (ed25519.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.rpcTimeout)
+	defer cancel()
+	var key ed25519.PublicKey
+	err := client.CallContext(expectSigner(ctx, other, &key), method, args, reply)
+	return key, err
 }
 
+// ContactNode returns a client for node from the server's connection pool,
+// dialing one if there is none. Nodes that both sides reach over TCP are
+// contacted over TCP, others over UDP. Pooled clients are shared and are
+// closed once idle for Options.ConnIdleTimeout or when the server shuts down.
 func (s Server) ContactNode(node Node) (*bsonrpc.Client, error) {
-	client, err := bsonrpc.Dial(node.Host, node.Port)
+	network := bsonrpc.UDP
+	if s.Node.Supports(bsonrpc.TCP) && node.Supports(bsonrpc.TCP) {
+		network = bsonrpc.TCP
+	}
+	client, err := s.pool.Get(network, node.Host, node.Port)
 	if err != nil {
-		return nil, fmt.Errorf("error contacting (UDP) node at %s", node)
+		return nil, fmt.Errorf("error contacting (%s) node at %s: %w", strings.ToUpper(network), node, err)
 	}
-
 	return client, nil
 }
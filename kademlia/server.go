@@ -1,43 +1,94 @@
 package kademlia
 
 import (
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"go-dht/bsonrpc"
 	"go-dht/pkg/util"
 	"log"
 	"math/big"
-	"sync"
+	"time"
 )
 
+var ErrNotFound = errors.New("value not found")
+
 type Server struct {
 	Node         Node
 	rpcServer    *bsonrpc.Server
-	dataStore    map[string]any
+	rpcOptions   []bsonrpc.ServerOption
+	dialOptions  []bsonrpc.ClientOption
+	pool         *bsonrpc.Pool
+	dataStore    Store
 	routingTable *RoutingTable
+	clock        Clock
+	schedule     Schedule
+	rpcTimeout   time.Duration
+	lifecycle    *lifecycle
+	identity     ed25519.PrivateKey
+	identityFile string
+
+	routingTableFile string
+	restored         []Node
 }
 
 func (s Server) Id() *big.Int {
 	return s.Node.Id
 }
 
-func NewServer(host string, port int) (Server, error) {
-	n := NewNode(host, port, nil)
+func NewServer(host string, port int, opts ...ServerOption) (Server, error) {
 	s := Server{
-		Node:         n,
-		dataStore:    make(map[string]any),
-		routingTable: NewRoutingTable(n, Options.BucketCapacity),
+		dataStore:  NewMemoryStore(),
+		clock:      systemClock{},
+		schedule:   DefaultSchedule(),
+		rpcTimeout: Options.RPCTimeout,
+		lifecycle:  &lifecycle{},
 	}
-	s.updateRoutingTable(s.Node)
-
-	bsonRpcServer, err := bsonrpc.NewServer(host, port)
+	for _, opt := range opts {
+		opt(&s)
+	}
+	if s.identity == nil && s.identityFile != "" {
+		key, err := loadIdentity(s.identityFile)
+		if err != nil {
+			return Server{}, fmt.Errorf("could not load identity from %s: %w", s.identityFile, err)
+		}
+		s.identity = key
+	}
+	if s.identity == nil {
+		_, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return Server{}, err
+		}
+		s.identity = key
+	}
+	s.rpcOptions = append(s.rpcOptions,
+		bsonrpc.WithSigningKey(s.identity), bsonrpc.WithEncryption(), bsonrpc.WithInterceptors(authenticate))
+	s.dialOptions = append(s.dialOptions,
+		bsonrpc.WithClientSigningKey(s.identity), bsonrpc.WithClientEncryption())
+	s.pool = bsonrpc.NewPool(s.dialOptions...)
+	bsonRpcServer, err := bsonrpc.NewServer(host, port, s.rpcOptions...)
 	if err != nil {
 		return Server{}, err
 	}
+	s.rpcServer = bsonRpcServer
+	publicKey := s.identity.Public().(ed25519.PublicKey)
+	s.Node = NewNode(host, bsonRpcServer.Port(), IdFromKey(publicKey))
+	s.Node.PublicKey = publicKey
+	s.Node.Transports = bsonRpcServer.Networks()
+	s.routingTable = NewRoutingTable(s.Node, Options.BucketCapacity, s.clock)
+	s.updateRoutingTable(s.Node)
+	if s.routingTableFile != "" {
+		s.restored, err = loadRoutingTable(s.routingTableFile, s.Node.Id)
+		if err != nil {
+			return Server{}, fmt.Errorf("could not load routing table from %s: %w", s.routingTableFile, err)
+		}
+	}
+
 	err = bsonRpcServer.Register(&s)
 	if err != nil {
 		return Server{}, err
 	}
-	s.rpcServer = bsonRpcServer
 
 	return s, nil
 }
@@ -50,86 +101,266 @@ func (s Server) Listen() {
 	go s.rpcServer.Listen()
 }
 
+// Shutdown stops the maintenance tasks, then stops accepting requests and
+// waits for the ones in flight to be answered before closing the socket.
+func (s Server) Shutdown(ctx context.Context) error {
+	s.Stop()
+	err := s.rpcServer.Shutdown(ctx)
+	s.pool.Close()
+	return err
+}
+
 func (s Server) Buckets() map[string]*KBucket {
-	return s.routingTable.BucketPrefixes
+	return s.routingTable.Buckets()
 }
 
-func (s Server) Bootstrap(bootstrapper Server) {
-	closestToBootstrapper, err := s.SendFindNode(s.Node.Id.Text(16), bootstrapper)
+// Bootstrap joins the network through the seed nodes at the given addresses,
+// "host:port" strings optionally prefixed with a network as PingAddress
+// accepts. The seeds' IDs are learned by pinging them, after which the
+// server looks itself up and refreshes every bucket farther away than its
+// closest neighbour.
+func (s Server) Bootstrap(ctx context.Context, seeds ...string) error {
+	reached := 0
+	for _, seed := range seeds {
+		_, err := s.PingAddress(ctx, seed)
+		if err != nil {
+			log.Printf("could not bootstrap %s against %s: %s", s.Node, seed, err)
+			continue
+		}
+		reached++
+	}
+	if reached == 0 {
+		return fmt.Errorf("could not reach any of the %d bootstrap nodes", len(seeds))
+	}
+
+	res, err := s.Lookup(ctx, s.Node.Id)
 	if err != nil {
-		log.Printf("could not bootstrap %s against %s %s", s.Node, bootstrapper.Node, err)
-		return
+		return err
+	}
+	var neighbour *Node
+	for _, n := range res.Closest {
+		if !n.Equals(s.Node) {
+			neighbour = &n
+			break
+		}
+	}
+	if neighbour == nil {
+		return nil
+	}
+	closest := s.Node.Xor(*neighbour)
+	var ids []*big.Int
+	for _, bucket := range s.Buckets() {
+		id := bucket.randomNum()
+		if id != nil && new(big.Int).Xor(id, s.Id()).Cmp(closest) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		if _, err := s.Lookup(ctx, id); err != nil {
+			return err
+		}
 	}
-	s.updateRoutingTable(closestToBootstrapper...)
-	s.Lookup(s.Node.Id)
-	// find buckets farher away
-	//
+	return nil
 }
 
-func (s Server) Refresh() {
+func (s Server) Refresh(ctx context.Context) {
 	for _, bucket := range s.Buckets() {
-		if bucket.shouldBeRefreshed() {
-			s.Lookup(bucket.randomNum())
+		if bucket.shouldBeRefreshed(s.clock.Now()) {
+			if _, err := s.Lookup(ctx, bucket.randomNum()); err != nil {
+				log.Printf("could not refresh bucket %q: %s", bucket.Prefix, err)
+			}
 		}
 	}
 }
 
-func (s Server) Lookup(key *big.Int) []Node {
+func (s Server) Lookup(ctx context.Context, key *big.Int) (*LookupResult, error) {
 	if key == nil {
-		return nil
-	}
-	lu := NewLookup(s, key)
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	nodes := lu.Execute()
-	wg.Done()
-	//wg.Wait()
-	fmt.Println(nodes)
-	for _, node := range nodes {
-		fmt.Println(node)
+		return &LookupResult{}, nil
 	}
-	return nodes
+	return NewLookup(s, key).Execute(ctx)
 }
 
 func (s Server) updateRoutingTable(node ...Node) {
-	var m sync.Mutex
-	m.Lock()
-	defer m.Unlock()
-
 	for _, n := range node {
-		s.routingTable.Add(n)
+		if stale, ok := s.routingTable.Add(n); ok {
+			go s.pingStale(stale)
+		}
 	}
 }
 
+// pingStale checks whether the least-recently seen contact of a full bucket
+// is still alive, evicting it in favour of a cached replacement if not.
+func (s Server) pingStale(n Node) {
+	if err := s.sendPing(context.Background(), n); err != nil {
+		log.Printf("evicting unresponsive node %s: %s", n, err)
+		s.routingTable.Remove(n)
+		return
+	}
+	s.routingTable.Responded(n)
+}
+
 func (s Server) DisplayRoutingTable() {
 	fmt.Println(s.routingTable)
 }
 
-func (s Server) Put(key string, value any) {
-	nodes := s.Lookup(util.HashToBigInt(util.GetHash(key)))
+func (s Server) Put(ctx context.Context, key string, value any) error {
+	ttl := time.Duration(Options.TExpiration) * time.Second
+	err := s.putRecord(key, value, ttl, true)
+	if err != nil {
+		return err
+	}
+	return s.store(ctx, key, value, ttl)
+}
+
+// store sends the value to the k closest nodes to the key, to be kept for
+// ttl, failing only if none of them accepted it.
+func (s Server) store(ctx context.Context, key string, value any, ttl time.Duration) error {
+	res, err := s.Lookup(ctx, keyId(key))
+	if err != nil {
+		return err
+	}
+	nodes := res.Closest
+	stored := 0
 	for _, n := range nodes {
-		err := s.sendStore(key, value, n)
+		err := s.sendStore(ctx, key, value, ttl, n)
 		if err != nil {
 			log.Println(err)
+			continue
 		}
+		stored++
+	}
+	if stored == 0 && len(nodes) > 0 {
+		return fmt.Errorf("could not store %q on any of %d nodes", key, len(nodes))
 	}
+	return nil
 }
 
-func (s Server) Get(key string) any {
-	if s.Has(key) {
-		return s.dataStore[key]
+// storeRecords sends each record to the k closest nodes of its key, like
+// store. The stores headed for the same node are sent together in batches,
+// so that republishing many keys costs a request per neighbour rather than
+// one per key and neighbour. The error for each record is returned in order.
+func (s Server) storeRecords(ctx context.Context, records []Record) []error {
+	type target struct {
+		node    Node
+		records []int
+	}
+	var targets []*target
+	byId := make(map[string]*target)
+	errs := make([]error, len(records))
+	tried := make([]int, len(records))
+	stored := make([]int, len(records))
+	for i, r := range records {
+		res, err := s.Lookup(ctx, keyId(r.Key))
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		tried[i] = len(res.Closest)
+		for _, n := range res.Closest {
+			t, ok := byId[n.Id.Text(16)]
+			if !ok {
+				t = &target{node: n}
+				byId[n.Id.Text(16)] = t
+				targets = append(targets, t)
+			}
+			t.records = append(t.records, i)
+		}
+	}
+
+	for _, t := range targets {
+		for start := 0; start < len(t.records); start += storeBatchSize {
+			batch := t.records[start:min(start+storeBatchSize, len(t.records))]
+			values := make([]Record, len(batch))
+			for j, i := range batch {
+				values[j] = records[i]
+			}
+			for j, err := range s.sendStores(ctx, values, t.node) {
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				stored[batch[j]]++
+			}
+		}
+	}
+	for i := range records {
+		if errs[i] == nil && stored[i] == 0 && tried[i] > 0 {
+			errs[i] = fmt.Errorf("could not store %q on any of %d nodes", records[i].Key, tried[i])
+		}
+	}
+	return errs
+}
+
+// Expire removes stored values whose time to live has elapsed.
+func (s Server) Expire() {
+	if err := s.expireRecords(); err != nil {
+		log.Printf("could not expire stored values: %s", err)
+	}
+}
+
+// Replicate sends the values this node holds for others to the k closest
+// nodes of each key, skipping keys that were stored within the last
+// TReplicate seconds.
+func (s Server) Replicate(ctx context.Context) {
+	records, err := s.dueRecords(time.Duration(Options.TReplicate)*time.Second, false)
+	if err != nil {
+		log.Printf("could not list values to replicate: %s", err)
+		return
+	}
+	for i, err := range s.storeRecords(ctx, records) {
+		if err != nil {
+			log.Printf("could not replicate %q: %s", records[i].Key, err)
+		}
+	}
+}
+
+// Republish stores the values originally published by this node again.
+func (s Server) Republish(ctx context.Context) {
+	records, err := s.dueRecords(time.Duration(Options.TRepublish)*time.Second, true)
+	if err != nil {
+		log.Printf("could not list values to republish: %s", err)
+		return
+	}
+	for i, err := range s.storeRecords(ctx, records) {
+		if err != nil {
+			log.Printf("could not republish %q: %s", records[i].Key, err)
+		}
 	}
-	//	nodes := s.Lookup(util.HashToBigInt(util.GetHash(key)))
-	//	for _, n := range nodes {
-	//		nodes, err := s.SendFindValue(key, val, n)
-	//		if err != nil {
-	//			return err
-	//		}
-	//	}
-	return nil
+}
+
+// Get returns the value stored under key. The local store is checked first,
+// after which an iterative FIND_VALUE lookup is run across the network.
+// ErrNotFound is returned when the nodes that were reached do not hold the key.
+func (s Server) Get(ctx context.Context, key string) (any, error) {
+	if r, ok := s.getRecord(key); ok {
+		return r.Value, nil
+	}
+	res, err := NewValueLookup(s, key).Execute(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if res.Found {
+		return res.Value, nil
+	}
+	// The server is in its own routing table, so it always answers its own
+	// lookups; only the other nodes tell whether the network was reached.
+	reached := false
+	for _, n := range res.Closest {
+		if !n.Equals(s.Node) {
+			reached = true
+		}
+	}
+	if !reached && res.Failures > 0 {
+		return nil, fmt.Errorf("could not reach any node while looking up %q", key)
+	}
+	return nil, ErrNotFound
 }
 
 func (s Server) Has(key string) bool {
-	val, ok := s.dataStore[key]
-	return ok && val != nil
+	_, ok := s.getRecord(key)
+	return ok
+}
+
+func keyId(key string) *big.Int {
+	return util.HashToBigInt(util.GetHash(key))
 }
@@ -0,0 +1,529 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"go-dht/bsonrpc"
+	"go-dht/pkg/util"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// fakeClock is a Clock whose time only moves when Advance is called. changed
+// is closed, and replaced, whenever a timer is registered.
+type fakeClock struct {
+	m       sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+	changed chan struct{}
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now(), changed: make(chan struct{})}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeTimer{deadline: c.now.Add(d), c: ch})
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.now = c.now.Add(d)
+	var pending []fakeTimer
+	for _, w := range c.waiters {
+		if !w.deadline.After(c.now) {
+			w.c <- c.now
+		} else {
+			pending = append(pending, w)
+		}
+	}
+	c.waiters = pending
+}
+
+// BlockUntil waits until n timers are waiting on the clock.
+func (c *fakeClock) BlockUntil(t *testing.T, n int) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		c.m.Lock()
+		waiting, changed := len(c.waiters), c.changed
+		c.m.Unlock()
+		if waiting >= n {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("timed out waiting for %d timers", n)
+		}
+	}
+}
+
+func TestServer_StartExpiresValues(t *testing.T) {
+	clock := newFakeClock()
+	s, err := NewServer("localhost", 0, WithClock(clock), WithSchedule(Schedule{Expire: time.Minute}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	var resp Response
+	err = s.Store(Args{Sender: s.Node, Key: "short", Data: "lived", TTL: 90}, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Store(Args{Sender: s.Node, Key: "long", Data: "lived", TTL: 300}, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err == nil {
+		t.Errorf("Starting a running server should fail")
+	}
+
+	for i := 0; i < 2; i++ {
+		clock.BlockUntil(t, 1)
+		clock.Advance(time.Minute)
+	}
+	clock.BlockUntil(t, 1)
+
+	if _, err := s.dataStore.Get("short"); err == nil {
+		t.Errorf("Values should be removed once their TTL has elapsed")
+	}
+	if !s.Has("long") {
+		t.Errorf("Values should be kept until their TTL has elapsed")
+	}
+}
+
+func TestServer_StartsAgainOnceContextIsCancelled(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		s, err := NewServer("localhost", 0, WithClock(newFakeClock()), WithSchedule(Schedule{Expire: time.Minute}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := s.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		synctest.Wait()
+		if err := s.Start(context.Background()); err != nil {
+			t.Errorf("A server whose context was cancelled should start again: %s", err)
+		}
+		s.Stop()
+	})
+}
+
+func newTestNetwork(t *testing.T, n int, opts ...ServerOption) []Server {
+	t.Helper()
+	servers := make([]Server, n)
+	for i := range servers {
+		s, err := NewServer("127.0.0.1", 0, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Listen()
+		t.Cleanup(func() { s.Shutdown(context.Background()) })
+		servers[i] = s
+	}
+	seed := fmt.Sprintf("%s:%d", servers[0].Node.Host, servers[0].Node.Port)
+	for _, s := range servers[1:] {
+		if err := s.Bootstrap(context.Background(), seed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return servers
+}
+
+func TestServer_ConcurrentLookups(t *testing.T) {
+	servers := newTestNetwork(t, 12)
+
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, s Server) {
+			defer wg.Done()
+			ctx := context.Background()
+			err := s.Put(ctx, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+			if err != nil {
+				t.Errorf("Put key-%d: %s", i, err)
+			}
+			_, err = s.Lookup(ctx, util.RandNumber())
+			if err != nil {
+				t.Errorf("Lookup: %s", err)
+			}
+			s.Refresh(ctx)
+		}(i, s)
+	}
+	wg.Wait()
+
+	for i := range servers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := servers[(i+5)%len(servers)]
+			val, err := s.Get(context.Background(), fmt.Sprintf("key-%d", i))
+			if err != nil {
+				t.Errorf("Get key-%d from %s: %s", i, s.Node, err)
+				return
+			}
+			if val != fmt.Sprintf("value-%d", i) {
+				t.Errorf("Get key-%d returned %v", i, val)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestServer_LookupDropsUnresponsivePeer(t *testing.T) {
+	servers := newTestNetwork(t, 6)
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	dead := NewNode("127.0.0.1", silent.LocalAddr().(*net.UDPAddr).Port, nil)
+
+	s, err := NewServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Listen()
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	s.routingTable.Add(dead)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*Options.RPCTimeout)
+	defer cancel()
+	_, err = s.PingAddress(ctx, fmt.Sprintf("%s:%d", servers[0].Node.Host, servers[0].Node.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.Lookup(ctx, new(big.Int).Xor(dead.Id, big.NewInt(1)))
+	if err != nil {
+		t.Fatalf("Lookup should not fail because of one unresponsive peer: %s", err)
+	}
+	if res.Failures != 1 || len(res.Closest) != Options.BucketCapacity {
+		t.Errorf("Lookup should report the failed peer and still find k nodes, got %+v", res)
+	}
+	for _, n := range res.Closest {
+		if n.Equals(dead) {
+			t.Errorf("Unresponsive peer should not be part of the lookup result")
+		}
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Lookup(ctx, util.RandNumber()); err == nil {
+		t.Errorf("Lookup with a cancelled context should fail")
+	}
+}
+
+func tableContains(rt *RoutingTable, n Node) bool {
+	for _, bucket := range rt.Buckets() {
+		bucket.m.Lock()
+		ok := bucket.contains(n)
+		bucket.m.Unlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServer_RestoresRoutingTable(t *testing.T) {
+	servers := newTestNetwork(t, 2)
+	path := filepath.Join(t.TempDir(), "routing.bson")
+	ctx := context.Background()
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer("127.0.0.1", 0, WithIdentity(key), WithRoutingTableFile(path), WithSchedule(Schedule{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	live, dead := servers[0].Node, NewNode("127.0.0.1", 1, nil)
+	s.routingTable.Add(dead)
+	s.routingTable.Add(live)
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.Stop()
+
+	saved, err := loadRoutingTable(path, s.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 {
+		t.Fatalf("Stopping should save every contact but the owner, got %v", saved)
+	}
+	if other, err := NewServer("127.0.0.1", 0, WithRoutingTableFile(path)); err != nil || len(other.restored) != 0 {
+		t.Errorf("A routing table saved by another node should not be restored, got %v (%v)", other.restored, err)
+	} else {
+		other.Shutdown(ctx)
+	}
+
+	restarted, err := NewServer("127.0.0.1", 0, WithIdentity(key), WithRoutingTableFile(path), WithSchedule(Schedule{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { restarted.Shutdown(context.Background()) })
+	if tableContains(restarted.routingTable, live) {
+		t.Errorf("Restored contacts should not be trusted before they answer a ping")
+	}
+	if err := restarted.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !tableContains(restarted.routingTable, live) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	restarted.Stop()
+
+	if !tableContains(restarted.routingTable, live) {
+		t.Errorf("Contacts that answer a ping should be restored")
+	}
+	if tableContains(restarted.routingTable, dead) {
+		t.Errorf("Unresponsive contacts should not be restored")
+	}
+}
+
+func TestServer_SavesRoutingTableOnSchedule(t *testing.T) {
+	clock := newFakeClock()
+	path := filepath.Join(t.TempDir(), "routing.bson")
+	s, err := NewServer("127.0.0.1", 0, WithClock(clock), WithRoutingTableFile(path),
+		WithSchedule(Schedule{RoutingTable: time.Minute}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	contact := NewNode("127.0.0.1", 1, util.RandNumber())
+	s.routingTable.Add(contact)
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	clock.BlockUntil(t, 1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(t, 1)
+
+	saved, err := loadRoutingTable(path, s.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || !saved[0].Equals(contact) {
+		t.Errorf("The routing table should be saved while the server runs, got %v", saved)
+	}
+}
+
+func TestServer_TCP(t *testing.T) {
+	servers := newTestNetwork(t, 6, WithTCP())
+	for _, n := range servers[1].routingTable.GetNearest(servers[1].Id()) {
+		if !n.Supports(bsonrpc.TCP) {
+			t.Errorf("Contacts should advertise TCP, got %v for %s", n.Transports, n)
+		}
+	}
+
+	ctx := context.Background()
+	value := bytes.Repeat([]byte{'v'}, 200<<10)
+	if err := servers[1].Put(ctx, "big", value); err != nil {
+		t.Fatal(err)
+	}
+	getter := servers[0]
+	for _, s := range servers {
+		if !s.Has("big") {
+			getter = s
+		}
+	}
+	got, err := getter.Get(ctx, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := got.([]byte); !ok || !bytes.Equal(b, value) {
+		t.Errorf("A large value should be stored and fetched over TCP, got %d bytes", len(b))
+	}
+}
+
+func TestServer_PingAddressUsesGivenNetwork(t *testing.T) {
+	servers := newTestNetwork(t, 2, WithTCP())
+	s, other := servers[0], servers[1]
+	address := fmt.Sprintf("%s:%d", other.Node.Host, other.Node.Port)
+
+	n, err := s.PingAddress(context.Background(), "tcp://"+address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.Equals(other.Node) || !n.Supports(bsonrpc.TCP) {
+		t.Errorf("PingAddress should return the node with its transports, got %s %v", n, n.Transports)
+	}
+	conns := s.pool.Len()
+	if _, err := s.pool.Get(bsonrpc.TCP, other.Node.Host, other.Node.Port); err != nil {
+		t.Fatal(err)
+	}
+	if s.pool.Len() != conns {
+		t.Errorf("A tcp:// address should be pinged over TCP, the pool had no TCP client for it")
+	}
+
+	if _, err := s.PingAddress(context.Background(), "sctp://"+address); err == nil {
+		t.Errorf("Addresses with an unknown network should be rejected")
+	}
+}
+
+func TestServer_ReusesConnections(t *testing.T) {
+	servers := newTestNetwork(t, 3)
+	s, other := servers[1], servers[2]
+	ctx := context.Background()
+
+	if err := s.SendPing(ctx, other.Node); err != nil {
+		t.Fatal(err)
+	}
+	conns := s.pool.Len()
+	for i := 0; i < 5; i++ {
+		if err := s.SendPing(ctx, other.Node); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.SendFindNode(ctx, other.Id().Text(16), other.Node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.pool.Len() != conns {
+		t.Errorf("Repeated RPCs to a node should reuse its connection, went from %d to %d", conns, s.pool.Len())
+	}
+
+	if _, err := s.ContactNode(NewNode("no-such-host.invalid", 1, nil)); err == nil || errors.Unwrap(err) == nil {
+		t.Errorf("Contact errors should wrap the underlying error, got %v", err)
+	}
+}
+
+func TestServer_Identity(t *testing.T) {
+	public, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer("127.0.0.1", 0, WithIdentity(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	if s.Id().Cmp(IdFromKey(public)) != 0 || !s.Node.PublicKey.Equal(public) {
+		t.Errorf("The node ID should be derived from the identity key, got %s", s.Node)
+	}
+
+	var decoded Node
+	data, err := s.Node.MarshalBSON()
+	if err == nil {
+		err = decoded.UnmarshalBSON(data)
+	}
+	if err != nil || !decoded.ownsKey(public) {
+		t.Errorf("Contacts should carry their public key, got %s (%v)", decoded, err)
+	}
+}
+
+func TestServer_IdentityFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+	start := func() Server {
+		t.Helper()
+		s, err := NewServer("127.0.0.1", 0, WithIdentityFile(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Shutdown(context.Background())
+		return s
+	}
+	first := start()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("The identity key should be saved readable by its owner only, got %v (%v)", info, err)
+	}
+	if again := start(); again.Id().Cmp(first.Id()) != 0 {
+		t.Errorf("A server restarted with the same identity file should keep its ID %s, got %s", first.Node, again.Node)
+	}
+
+	if err := os.WriteFile(path, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer("127.0.0.1", 0, WithIdentityFile(path)); err == nil {
+		t.Errorf("A malformed identity file should be refused")
+	}
+}
+
+func TestServer_RejectsForgedContacts(t *testing.T) {
+	servers := newTestNetwork(t, 2)
+	target, other := servers[0], servers[1]
+	mallory, err := NewServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory.Listen()
+	defer mallory.Shutdown(context.Background())
+	ctx := context.Background()
+
+	client, err := mallory.ContactNode(target.Node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := NewNode(mallory.Node.Host, mallory.Node.Port, big.NewInt(42))
+	forged.PublicKey = mallory.Node.PublicKey
+	var resp Response
+	if err := client.CallContext(ctx, "Server.Ping", Args{Sender: forged}, &resp); err == nil {
+		t.Errorf("A sender whose ID is not derived from the signing key should be rejected")
+	}
+	if tableContains(target.routingTable, forged) {
+		t.Errorf("A forged sender should not be added to the routing table")
+	}
+
+	unsigned, err := bsonrpc.Dial(target.Node.Host, target.Node.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsigned.Close()
+	if err := unsigned.CallContext(ctx, "Server.Ping", Args{Sender: other.Node}, &resp); err == nil {
+		t.Errorf("An unsigned request should be rejected")
+	}
+
+	impostor := other.Node
+	impostor.Id = big.NewInt(42)
+	if err := mallory.SendPing(ctx, impostor); err == nil {
+		t.Errorf("A reply not signed by the key behind the contacted ID should fail the call")
+	}
+	if tableContains(mallory.routingTable, impostor) {
+		t.Errorf("A contact whose reply is signed by another node should not be added to the routing table")
+	}
+	if err := mallory.SendPing(ctx, other.Node); err != nil || !tableContains(mallory.routingTable, other.Node) {
+		t.Errorf("A genuine contact should be added to the routing table, got %v", err)
+	}
+}
@@ -0,0 +1,420 @@
+package kademlia
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"go-dht/bsonrpc"
+	"go-dht/simnet"
+	"math/big"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// simulatedRPCTimeout is the RPC timeout of simulated servers.
+const simulatedRPCTimeout = 200 * time.Millisecond
+
+// newSimulatedNetwork starts n servers on a simulated network, each on its
+// own host, and bootstraps them all through the first one. Tests call it
+// inside a synctest bubble, so that delays and RPC timeouts run on the
+// bubble's virtual clock and runs with the same seeds are reproducible.
+func newSimulatedNetwork(t *testing.T, sim *simnet.Network, n int, opts ...ServerOption) []Server {
+	t.Helper()
+	t.Cleanup(func() { sim.Close() })
+	servers := make([]Server, n)
+	for i := range servers {
+		servers[i] = newSimulatedServer(t, sim, fmt.Sprintf("node-%d", i), opts...)
+	}
+	for _, s := range servers[1:] {
+		if err := s.Bootstrap(context.Background(), "node-0:1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return servers
+}
+
+// newSimulatedServer starts a server on port 1 of host. Its identity key,
+// and so its ID, derives from the network's seed and the host.
+func newSimulatedServer(t *testing.T, sim *simnet.Network, host string, opts ...ServerOption) Server {
+	t.Helper()
+	seed := sha256.Sum256([]byte(fmt.Sprintf("%d/%s", sim.Seed(), host)))
+	opts = append([]ServerOption{
+		WithNetwork(sim.Host(host)),
+		WithIdentity(ed25519.NewKeyFromSeed(seed[:])),
+		WithSchedule(Schedule{}),
+		WithRPCTimeout(simulatedRPCTimeout),
+	}, opts...)
+	s, err := NewServer(host, 1, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Listen()
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+// withInterceptors adds interceptors around the requests the server handles.
+func withInterceptors(interceptors ...bsonrpc.ServerInterceptor) ServerOption {
+	return func(s *Server) {
+		s.rpcOptions = append(s.rpcOptions, bsonrpc.WithInterceptors(interceptors...))
+	}
+}
+
+func TestSimulation_LookupsUnderChurn(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		size := 200
+		if testing.Short() {
+			size = 50
+		}
+		sim := simnet.New(1, simnet.Config{})
+		servers := newSimulatedNetwork(t, sim, size)
+		sim.SetConfig(simnet.Config{
+			Latency: time.Millisecond,
+			Jitter:  time.Millisecond,
+			Loss:    0.01,
+			Reorder: 0.05,
+		})
+		rng := rand.New(rand.NewSource(1))
+		ctx := context.Background()
+
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if err := servers[rng.Intn(size)].Put(ctx, key, key); err != nil {
+				t.Fatal(err)
+			}
+			got, err := servers[rng.Intn(size)].Get(ctx, key)
+			if err != nil || got != key {
+				t.Errorf("Get(%s) on a lossy network = %v, %v", key, got, err)
+			}
+		}
+
+		// Take a tenth of the nodes down; lookups should route around them and
+		// only return nodes that are still up.
+		down := make(map[string]bool)
+		for _, i := range rng.Perm(size - 1)[:size/10] {
+			s := servers[i+1]
+			s.Shutdown(ctx)
+			down[s.Node.Host] = true
+		}
+		for i := 0; i < 20; i++ {
+			s := servers[rng.Intn(size)]
+			for down[s.Node.Host] {
+				s = servers[rng.Intn(size)]
+			}
+			res, err := s.Lookup(ctx, keyId(fmt.Sprintf("churn-%d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Closest) != Options.BucketCapacity {
+				t.Errorf("Lookups should still find %d nodes, got %d", Options.BucketCapacity, len(res.Closest))
+			}
+			for _, n := range res.Closest {
+				if down[n.Host] {
+					t.Errorf("Lookup returned %s, which is down", n)
+				}
+			}
+		}
+	})
+}
+
+func TestSimulation_Partition(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		sim := simnet.New(2, simnet.Config{Latency: time.Millisecond})
+		servers := newSimulatedNetwork(t, sim, 40)
+		ctx := context.Background()
+
+		var left, right []string
+		for i, s := range servers {
+			if i%2 == 0 {
+				left = append(left, s.Node.Host)
+			} else {
+				right = append(right, s.Node.Host)
+			}
+		}
+		sim.Partition(left, right)
+		if err := servers[1].SendPing(ctx, servers[0].Node); err == nil {
+			t.Errorf("Nodes on opposite sides of a partition should not reach each other")
+		}
+		if err := servers[2].SendPing(ctx, servers[0].Node); err != nil {
+			t.Errorf("Nodes on the same side of a partition should reach each other: %s", err)
+		}
+
+		sim.Heal()
+		if err := servers[1].SendPing(ctx, servers[0].Node); err != nil {
+			t.Errorf("Nodes should reach each other once the partition heals: %s", err)
+		}
+	})
+}
+
+func TestSimulation_Republish(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		clock := newFakeClock()
+		sim := simnet.New(3, simnet.Config{Latency: time.Millisecond})
+		servers := newSimulatedNetwork(t, sim, 8, WithClock(clock))
+		byHost := make(map[string]Server)
+		for _, s := range servers {
+			byHost[s.Node.Host] = s
+		}
+		ctx := context.Background()
+
+		// More keys than fit in one batch, so that some neighbours get several.
+		origin := servers[3]
+		keys := 2*storeBatchSize + 5
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("republished-%d", i)
+			if err := origin.putRecord(key, key, time.Duration(Options.TExpiration)*time.Second, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		clock.Advance(time.Duration(Options.TRepublish) * time.Second)
+		origin.Republish(ctx)
+
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("republished-%d", i)
+			res, err := origin.Lookup(ctx, keyId(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, n := range res.Closest {
+				if !byHost[n.Host].Has(key) {
+					t.Errorf("%s should have been republished to %s", key, n)
+				}
+			}
+		}
+	})
+}
+
+func TestSimulation_LookupsQueryAroundSlowPeers(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		const delay = 3 * simulatedRPCTimeout / 4
+		sim := simnet.New(4, simnet.Config{Latency: time.Millisecond})
+		var m sync.Mutex
+		var start time.Time
+		var queried []time.Duration
+		servers := newSimulatedNetwork(t, sim, 10, withInterceptors(func(info bsonrpc.RequestInfo, args any, next bsonrpc.Handler) (any, error) {
+			m.Lock()
+			if info.Method == "Server.FindNode" && !start.IsZero() {
+				queried = append(queried, time.Since(start))
+			}
+			m.Unlock()
+			return next(args)
+		}))
+		slow := newSimulatedServer(t, sim, "slow", withInterceptors(func(info bsonrpc.RequestInfo, args any, next bsonrpc.Handler) (any, error) {
+			if info.Method == "Server.FindNode" {
+				time.Sleep(delay)
+			}
+			return next(args)
+		}))
+		ctx := context.Background()
+		if err := slow.Bootstrap(ctx, "node-0:1"); err != nil {
+			t.Fatal(err)
+		}
+		initiator := servers[1]
+		if err := initiator.SendPing(ctx, slow.Node); err != nil {
+			t.Fatal(err)
+		}
+
+		m.Lock()
+		start = time.Now()
+		m.Unlock()
+		res, err := initiator.Lookup(ctx, new(big.Int).Xor(slow.Id(), big.NewInt(1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Closest) == 0 || !res.Closest[0].Equals(slow.Node) {
+			t.Errorf("The late reply of the slow node should be kept, got %v", res.Closest)
+		}
+		m.Lock()
+		defer m.Unlock()
+		soft := simulatedRPCTimeout / 4
+		for _, d := range queried {
+			if d >= soft && d < delay {
+				return
+			}
+		}
+		t.Errorf("Another node should be queried once the slow one passes the soft timeout, queries arrived after %v", queried)
+	})
+}
+
+func TestSimulation_ReplicasKeepTheRemainingTTL(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		clock := newFakeClock()
+		sim := simnet.New(5, simnet.Config{Latency: time.Millisecond})
+		servers := newSimulatedNetwork(t, sim, 8, WithClock(clock))
+		ctx := context.Background()
+
+		interval := time.Duration(Options.TReplicate) * time.Second
+		holder := servers[2]
+		var resp Response
+		err := holder.Store(Args{Sender: servers[5].Node, Key: "replicated", Data: "value", TTL: int(3 * interval / time.Second)}, &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(interval)
+		holder.Replicate(ctx)
+
+		var replicas []Server
+		for _, s := range servers {
+			r, err := s.dataStore.Get("replicated")
+			if err != nil || s.Node.Equals(holder.Node) {
+				continue
+			}
+			if r.TTL != 2*interval {
+				t.Errorf("The replica on %s should live for the remaining %v, got %v", s.Node, 2*interval, r.TTL)
+			}
+			replicas = append(replicas, s)
+		}
+		if len(replicas) == 0 {
+			t.Fatal("The value should have been replicated")
+		}
+
+		clock.Advance(2 * interval)
+		for _, s := range append(replicas, holder) {
+			s.Expire()
+			if _, err := s.dataStore.Get("replicated"); err == nil {
+				t.Errorf("%s should drop the value when its original TTL elapses", s.Node)
+			}
+		}
+	})
+}
+
+// TestSimulation_DefaultOptionsKeepValues runs the maintenance tasks on
+// their default schedule with the default Options, past the expiration time
+// of a published value, checking that some node besides its publisher holds
+// it throughout and that a replica is passed on by Replicate.
+func TestSimulation_DefaultOptionsKeepValues(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		clock := newFakeClock()
+		sim := simnet.New(8, simnet.Config{Latency: time.Millisecond})
+		var m sync.Mutex
+		replicatedBy := make(map[string]bool)
+		servers := newSimulatedNetwork(t, sim, 8, WithClock(clock), WithSchedule(DefaultSchedule()), withInterceptors(func(info bsonrpc.RequestInfo, args any, next bsonrpc.Handler) (any, error) {
+			if a, ok := args.(Args); ok && info.Method == "Server.Store" && a.Key == "replicated" {
+				m.Lock()
+				replicatedBy[a.Sender.Host] = true
+				m.Unlock()
+			}
+			return next(args)
+		}))
+		ctx := context.Background()
+		for _, s := range servers {
+			if err := s.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		synctest.Wait()
+
+		// Publish halfway between two runs of the tasks, so that a value
+		// expiring when it is due to be republished lapses before the next run.
+		step := DefaultSchedule().Republish / 2
+		clock.Advance(step)
+		time.Sleep(time.Second)
+		origin, holder := servers[3], servers[2]
+		if err := origin.Put(ctx, "published", "value"); err != nil {
+			t.Fatal(err)
+		}
+		var resp Response
+		if err := holder.Store(Args{Sender: servers[5].Node, Key: "replicated", Data: "value"}, &resp); err != nil {
+			t.Fatal(err)
+		}
+
+		end := time.Duration(Options.TExpiration+Options.TRepublish) * time.Second
+		for elapsed := step; elapsed <= end; elapsed += step {
+			clock.Advance(step)
+			time.Sleep(time.Second)
+			held := false
+			for _, s := range servers {
+				held = held || (s.Has("published") && !s.Node.Equals(origin.Node))
+			}
+			if !held {
+				t.Fatalf("%v after it was published, no node besides its publisher holds the value", elapsed)
+			}
+		}
+		m.Lock()
+		defer m.Unlock()
+		if !replicatedBy[holder.Node.Host] {
+			t.Errorf("Replicate should send the values a node holds for others, only %v did", replicatedBy)
+		}
+	})
+}
+
+func TestSimulation_Get(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		sim := simnet.New(6, simnet.Config{Latency: time.Millisecond})
+		servers := newSimulatedNetwork(t, sim, 12)
+		ctx := context.Background()
+
+		if err := servers[0].Put(ctx, "stored", "value"); err != nil {
+			t.Fatal(err)
+		}
+		var getter Server
+		for _, s := range servers[1:] {
+			if !s.Has("stored") {
+				getter = s
+				break
+			}
+		}
+		if getter.rpcServer == nil {
+			t.Fatal("Every node holds the value, none has to look it up")
+		}
+		got, err := getter.Get(ctx, "stored")
+		if err != nil || got != "value" {
+			t.Errorf("Get should find a value held by other nodes, got %v (%v)", got, err)
+		}
+		if _, err := getter.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get of a key no node holds should return ErrNotFound, got %v", err)
+		}
+
+		for _, s := range servers[2:] {
+			s.Shutdown(ctx)
+		}
+		servers[0].Shutdown(ctx)
+		if _, err := servers[1].Get(ctx, "missing"); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("Get should tell unreachable nodes apart from a missing key, got %v", err)
+		}
+	})
+}
+
+func TestSimulation_Bootstrap(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		sim := simnet.New(7, simnet.Config{Latency: time.Millisecond})
+		servers := newSimulatedNetwork(t, sim, 20)
+		ctx := context.Background()
+
+		newcomer := newSimulatedServer(t, sim, "newcomer")
+		if err := newcomer.Bootstrap(ctx, "nowhere:1", "node-3:1"); err != nil {
+			t.Fatalf("Bootstrap should succeed as long as one seed answers: %s", err)
+		}
+		// The newcomer's lookup of itself should have found its k closest
+		// nodes, and told the seed about it, which keeps it in a bucket or
+		// as a replacement if the bucket is full.
+		sorted := append([]Server(nil), servers...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return newcomer.Node.Xor(sorted[i].Node).Cmp(newcomer.Node.Xor(sorted[j].Node)) < 0
+		})
+		for _, s := range sorted[:Options.BucketCapacity] {
+			if !tableContains(newcomer.routingTable, s.Node) {
+				t.Errorf("Bootstrap should find %s, one of the %d closest nodes", s.Node, Options.BucketCapacity)
+			}
+		}
+		learned := tableContains(servers[3].routingTable, newcomer.Node)
+		for _, bucket := range servers[3].Buckets() {
+			learned = learned || slices.ContainsFunc(bucket.Replacements(), newcomer.Node.Equals)
+		}
+		if !learned {
+			t.Errorf("The seed should learn about the newcomer")
+		}
+
+		lonely := newSimulatedServer(t, sim, "lonely")
+		if err := lonely.Bootstrap(ctx, "nowhere:1"); err == nil {
+			t.Errorf("Bootstrap should fail when no seed answers")
+		}
+	})
+}
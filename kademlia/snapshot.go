@@ -0,0 +1,125 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"go-dht/bson"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+)
+
+// routingSnapshot is the on-disk form of a routing table: the node it belongs
+// to and its contacts, most recently seen first. Times are stored as Unix
+// nanoseconds. Buckets are not saved, as restored contacts are only added
+// back once they answer, which splits and refreshes the buckets anew.
+type routingSnapshot struct {
+	Owner    Node
+	Contacts []contactSnapshot
+}
+
+type contactSnapshot struct {
+	Node     Node
+	LastSeen int64
+}
+
+func (rt *RoutingTable) snapshot() routingSnapshot {
+	rt.m.RLock()
+	defer rt.m.RUnlock()
+
+	snap := routingSnapshot{Owner: rt.Owner}
+	for _, bucket := range rt.BucketPrefixes {
+		bucket.m.Lock()
+		for ptr := bucket.Head; ptr != nil; ptr = ptr.Next {
+			if ptr.Data.Equals(rt.Owner) {
+				continue
+			}
+			snap.Contacts = append(snap.Contacts, contactSnapshot{Node: ptr.Data, LastSeen: ptr.LastSeen.UnixNano()})
+		}
+		bucket.m.Unlock()
+	}
+	sort.Slice(snap.Contacts, func(i, j int) bool {
+		return snap.Contacts[i].LastSeen > snap.Contacts[j].LastSeen
+	})
+	return snap
+}
+
+// SaveRoutingTable writes the routing table's owner, contacts and last-seen
+// times to path as BSON. The file is replaced atomically.
+func (s Server) SaveRoutingTable(path string) error {
+	data, err := bson.Marshal(s.routingTable.snapshot())
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadRoutingTable reads the contacts saved at path by the node whose ID is
+// owner, most recently seen first. A missing file, or one saved by another
+// node, yields no contacts: distances in another node's table are measured
+// from that node's ID.
+func loadRoutingTable(path string, owner *big.Int) ([]Node, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap routingSnapshot
+	if err := bson.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	if snap.Owner.Id == nil || snap.Owner.Id.Cmp(owner) != 0 {
+		log.Printf("ignoring the routing table saved at %s by %s", path, snap.Owner)
+		return nil, nil
+	}
+	nodes := make([]Node, len(snap.Contacts))
+	for i, c := range snap.Contacts {
+		nodes[i] = c.Node
+	}
+	return nodes, nil
+}
+
+// revalidate pings the contacts restored from disk, Options.Alpha at a time.
+// Only the ones that answer are added to the routing table.
+func (s Server) revalidate(ctx context.Context, contacts []Node) {
+	work := make(chan Node)
+	var wg sync.WaitGroup
+	for i := 0; i < Options.Alpha; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range work {
+				if err := s.sendPing(ctx, n); err != nil {
+					log.Printf("dropping restored contact %s: %s", n, err)
+				}
+			}
+		}()
+	}
+loop:
+	for _, n := range contacts {
+		select {
+		case work <- n:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(work)
+	wg.Wait()
+}
+
+func (s Server) saveRoutingTable() {
+	if s.routingTableFile == "" {
+		return
+	}
+	if err := s.SaveRoutingTable(s.routingTableFile); err != nil {
+		log.Printf("could not save routing table to %s: %s", s.routingTableFile, err)
+	}
+}
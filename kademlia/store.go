@@ -0,0 +1,225 @@
+package kademlia
+
+import (
+	"sync"
+	"time"
+)
+
+// Record is a stored value together with the metadata used to expire and
+// republish it.
+type Record struct {
+	Key       string
+	Value     any
+	StoredAt  time.Time
+	TTL       time.Duration
+	Original  bool
+	Published time.Time
+}
+
+// Expired reports whether the record's time to live has elapsed. Records put
+// by their original publisher never expire locally; they are republished
+// instead.
+func (r Record) Expired(now time.Time) bool {
+	return !r.Original && r.TTL > 0 && now.Sub(r.StoredAt) >= r.TTL
+}
+
+// RemainingTTL returns how much longer the record should live on the nodes it
+// is sent to: its whole TTL if it was put by its original publisher, which
+// renews it each time it is republished, and what is left of it otherwise.
+func (r Record) RemainingTTL(now time.Time) time.Duration {
+	if r.Original {
+		return r.TTL
+	}
+	return r.TTL - now.Sub(r.StoredAt)
+}
+
+// ttlSeconds converts a TTL to the whole seconds sent in Args.TTL, rounding
+// up so that a TTL that has not run out is never sent as zero, which would
+// mean the default.
+func ttlSeconds(ttl time.Duration) int {
+	return int((ttl + time.Second - 1) / time.Second)
+}
+
+// Store is the storage backend for the values a Server is responsible for.
+// Get returns ErrNotFound for missing keys. Update reads, modifies and writes
+// back the record under key atomically with respect to the store's other
+// methods: fn is given the record, or a new one holding only the key if there
+// is none along with found set to false, and the record is written back if fn
+// returns true. Iterate calls fn for every record until fn returns false. The
+// functions passed to Update and Iterate must not call back into the store.
+type Store interface {
+	Get(key string) (Record, error)
+	Put(r Record) error
+	Update(key string, fn func(r *Record, found bool) bool) error
+	Delete(key string) error
+	Iterate(fn func(Record) bool) error
+	Len() int
+}
+
+// MemoryStore is the default Store, keeping every record in a map.
+type MemoryStore struct {
+	m       sync.RWMutex
+	records map[string]Record
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]Record)}
+}
+
+func (ms *MemoryStore) Get(key string) (Record, error) {
+	ms.m.RLock()
+	defer ms.m.RUnlock()
+
+	r, ok := ms.records[key]
+	if !ok {
+		return Record{}, ErrNotFound
+	}
+	return r, nil
+}
+
+func (ms *MemoryStore) Put(r Record) error {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	ms.records[r.Key] = r
+	return nil
+}
+
+func (ms *MemoryStore) Update(key string, fn func(r *Record, found bool) bool) error {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	r, ok := ms.records[key]
+	if !ok {
+		r = Record{Key: key}
+	}
+	if fn(&r, ok) {
+		ms.records[key] = r
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Delete(key string) error {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	delete(ms.records, key)
+	return nil
+}
+
+func (ms *MemoryStore) Iterate(fn func(Record) bool) error {
+	ms.m.RLock()
+	defer ms.m.RUnlock()
+
+	for _, r := range ms.records {
+		if !fn(r) {
+			break
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Len() int {
+	ms.m.RLock()
+	defer ms.m.RUnlock()
+
+	return len(ms.records)
+}
+
+// getRecord returns the unexpired record stored under key.
+func (s Server) getRecord(key string) (Record, bool) {
+	r, err := s.dataStore.Get(key)
+	if err != nil || r.Value == nil || r.Expired(s.clock.Now()) {
+		return Record{}, false
+	}
+	return r, true
+}
+
+// putRecord stores value under key, keeping the original publisher flag of
+// an existing record so that a STORE echoed back to the publisher does not
+// turn its value into a replica. A replica never brings the expiry of the
+// record forward: one sent by a neighbour with what is left of its TTL may
+// arrive just after the publisher has renewed the value.
+func (s Server) putRecord(key string, value any, ttl time.Duration, original bool) error {
+	now := s.clock.Now()
+	return s.dataStore.Update(key, func(r *Record, found bool) bool {
+		if !found {
+			r.Published = now
+		}
+		remaining := ttl
+		if found && !original && r.TTL > 0 && r.TTL-now.Sub(r.StoredAt) > ttl {
+			remaining = r.TTL - now.Sub(r.StoredAt)
+		}
+		r.Value = value
+		r.StoredAt = now
+		r.TTL = remaining
+		r.Original = r.Original || original
+		if original {
+			r.Published = now
+		}
+		return true
+	})
+}
+
+func (s Server) expireRecords() error {
+	now := s.clock.Now()
+	var expired []string
+	err := s.dataStore.Iterate(func(r Record) bool {
+		if r.Expired(now) {
+			expired = append(expired, r.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range expired {
+		if err := s.dataStore.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dueRecords returns the records that have not been published or stored
+// within the given interval, marking them as published now. Each record is
+// checked again and marked in a single Update, so that a value stored in the
+// meantime is neither overwritten nor skipped.
+func (s Server) dueRecords(interval time.Duration, original bool) ([]Record, error) {
+	now := s.clock.Now()
+	isDue := func(r Record) bool {
+		if r.Original != original || r.Expired(now) {
+			return false
+		}
+		last := r.Published
+		if r.StoredAt.After(last) && !original {
+			last = r.StoredAt
+		}
+		return now.Sub(last) >= interval
+	}
+	var keys []string
+	err := s.dataStore.Iterate(func(r Record) bool {
+		if isDue(r) {
+			keys = append(keys, r.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	var due []Record
+	for _, key := range keys {
+		err := s.dataStore.Update(key, func(r *Record, found bool) bool {
+			if !found || !isDue(*r) {
+				return false
+			}
+			r.Published = now
+			due = append(due, *r)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return due, nil
+}
@@ -0,0 +1,84 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ms := NewMemoryStore()
+	if _, err := ms.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a missing key = %v, want ErrNotFound", err)
+	}
+	if err := ms.Put(Record{Key: "a", Value: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	ms.Update("b", func(r *Record, found bool) bool {
+		if found {
+			t.Errorf("Update should report missing keys as not found")
+		}
+		return false
+	})
+	if ms.Len() != 1 {
+		t.Errorf("An Update returning false should not write, got %d records", ms.Len())
+	}
+	ms.Update("a", func(r *Record, found bool) bool {
+		r.Value = r.Value.(string) + "2"
+		return found
+	})
+	if r, err := ms.Get("a"); err != nil || r.Value != "12" {
+		t.Errorf("Get after Update = %v (%v), want 12", r.Value, err)
+	}
+	if err := ms.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a deleted key = %v, want ErrNotFound", err)
+	}
+}
+
+func TestServer_WithStore(t *testing.T) {
+	store := NewMemoryStore()
+	s, err := NewServer("127.0.0.1", 0, WithStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	var resp Response
+	if err := s.Store(Args{Sender: s.Node, Key: "k", Data: "v"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := store.Get("k"); err != nil || r.Value != "v" {
+		t.Errorf("Stored values should go to the given store, got %v (%v)", r.Value, err)
+	}
+}
+
+func TestServer_StoreDuringRepublishIsNotLost(t *testing.T) {
+	s := Server{dataStore: NewMemoryStore(), clock: systemClock{}}
+	for i := 0; i < 200; i++ {
+		if err := s.putRecord("k", i, time.Hour, false); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := s.putRecord("k", i+1, time.Hour, false); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := s.dueRecords(0, false); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+		if r, ok := s.getRecord("k"); !ok || r.Value != i+1 {
+			t.Fatalf("A value stored during a republish pass was lost: got %v, want %d", r.Value, i+1)
+		}
+	}
+}
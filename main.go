@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"go-dht/kademlia"
 )
@@ -9,11 +10,17 @@ func initServers(n int) ([]kademlia.Server, error) {
 	servers := make([]kademlia.Server, n)
 	var err error
 	for i := 0; i < len(servers); i++ {
-		servers[i], err = kademlia.NewServer("localhost", 8000+i)
+		port := 8000 + i
+		servers[i], err = kademlia.NewServer("localhost", port,
+			kademlia.WithIdentityFile(fmt.Sprintf("node-%d.key", port)))
 		if err != nil {
 			return nil, err
 		}
 		servers[i].Listen()
+		err = servers[i].Start(context.Background())
+		if err != nil {
+			return nil, err
+		}
 	}
 	return servers, nil
 }
@@ -42,7 +49,7 @@ func main() {
 
 		//fmt.Println(xor.Bit(0), xor.Bit(1), xor.Bit(2), xor.Bit(3), len(text), text[0:5])
 		for j := i + 1; j < len(servers); j++ {
-			err = servers[i].SendPing(servers[j])
+			err = servers[i].SendPing(context.Background(), servers[j].Node)
 			if err != nil {
 				panic(err)
 			}
@@ -0,0 +1,489 @@
+// Package simnet is an in-memory packet network for running many bsonrpc
+// servers in one process. Datagrams between hosts can be delayed, dropped,
+// reordered and blocked by partitions. Every decision is drawn from a random
+// source seeded from the network's seed and the two hosts of the link, so a
+// run with the same seed makes the same decisions for the same traffic.
+//
+// Delayed datagrams wait in a queue ordered by delivery time, and ties are
+// broken by the order they were sent in. The queue runs on the time package,
+// so a Network used inside a testing/synctest bubble is driven by the
+// bubble's virtual clock: delays cost no real time, and the timeouts of the
+// servers on it advance in step with the network.
+package simnet
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"go-dht/bsonrpc"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Config describes the conditions of every link in a Network.
+type Config struct {
+	// Latency is the base delay of each datagram, and Jitter the largest
+	// random delay added on top of it.
+	Latency time.Duration
+	Jitter  time.Duration
+	// Loss is the probability that a datagram is dropped.
+	Loss float64
+	// Reorder is the probability that a datagram is held back by an extra
+	// Latency+Jitter, letting later datagrams overtake it.
+	Reorder float64
+}
+
+// inboxSize is how many datagrams a socket buffers before dropping new ones,
+// like a full UDP receive buffer.
+const inboxSize = 1024
+
+// ephemeralPort is the first port handed out to dialed sockets.
+const ephemeralPort = 32768
+
+// Network is a set of simulated hosts and the links between them.
+type Network struct {
+	m          sync.Mutex
+	seed       int64
+	config     Config
+	links      map[string]*rand.Rand
+	sockets    map[string]*conn
+	nextPort   map[string]int
+	partitions map[string]int
+
+	queue      deliveryQueue
+	sent       uint64
+	dispatcher bool
+	wake       chan struct{}
+	done       chan struct{}
+	once       sync.Once
+}
+
+// New returns a network whose random decisions derive from seed.
+func New(seed int64, config Config) *Network {
+	return &Network{
+		seed:     seed,
+		config:   config,
+		links:    make(map[string]*rand.Rand),
+		sockets:  make(map[string]*conn),
+		nextPort: make(map[string]int),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Close stops delivering delayed datagrams. Those still in flight are lost.
+func (n *Network) Close() error {
+	n.once.Do(func() { close(n.done) })
+	return nil
+}
+
+// Seed returns the seed the network's random decisions derive from, for
+// callers that derive other simulated state, such as node identities, from
+// it too.
+func (n *Network) Seed() int64 {
+	return n.seed
+}
+
+// SetConfig changes the link conditions for datagrams sent from now on.
+func (n *Network) SetConfig(config Config) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.config = config
+}
+
+// Partition splits hosts into groups that cannot reach each other. Hosts not
+// named in any group can still reach every host.
+func (n *Network) Partition(groups ...[]string) {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	n.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, host := range group {
+			n.partitions[host] = i
+		}
+	}
+}
+
+// Heal removes every partition.
+func (n *Network) Heal() {
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.partitions = nil
+}
+
+// Host returns the bsonrpc.Network seen by a process running on host:
+// sockets it dials send from host, so partitions apply to them too.
+func (n *Network) Host(host string) bsonrpc.Network {
+	return Host{network: n, name: host}
+}
+
+// Host is the view of a Network from one host.
+type Host struct {
+	network *Network
+	name    string
+}
+
+func (h Host) ListenPacket(host string, port int) (net.PacketConn, error) {
+	return h.network.listen(Addr{Host: host, Port: port})
+}
+
+func (h Host) DialPacket(host string, port int) (net.Conn, error) {
+	c, err := h.network.listen(Addr{Host: h.name})
+	if err != nil {
+		return nil, err
+	}
+	c.remote = &Addr{Host: host, Port: port}
+	return c, nil
+}
+
+// Addr is the address of a simulated socket.
+type Addr struct {
+	Host string
+	Port int
+}
+
+func (a Addr) Network() string {
+	return "sim"
+}
+
+func (a Addr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+func (n *Network) listen(addr Addr) (*conn, error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	if addr.Port == 0 {
+		port := n.nextPort[addr.Host]
+		if port == 0 {
+			port = ephemeralPort
+		}
+		for n.sockets[Addr{addr.Host, port}.String()] != nil {
+			port++
+		}
+		n.nextPort[addr.Host] = port + 1
+		addr.Port = port
+	}
+	if n.sockets[addr.String()] != nil {
+		return nil, fmt.Errorf("simnet: address %s already in use", addr)
+	}
+	c := &conn{
+		network: n,
+		local:   addr,
+		closed:  make(chan struct{}),
+		wake:    make(chan struct{}, 1),
+	}
+	n.sockets[addr.String()] = c
+	return c, nil
+}
+
+func (n *Network) unlisten(c *conn) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if n.sockets[c.local.String()] == c {
+		delete(n.sockets, c.local.String())
+	}
+}
+
+// link returns the random source for datagrams from src to dst.
+func (n *Network) link(src, dst string) *rand.Rand {
+	key := src + ">" + dst
+	r, ok := n.links[key]
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		r = rand.New(rand.NewPCG(uint64(n.seed), h.Sum64()))
+		n.links[key] = r
+	}
+	return r
+}
+
+func (n *Network) reachable(src, dst string) bool {
+	a, okA := n.partitions[src]
+	b, okB := n.partitions[dst]
+	return !okA || !okB || a == b
+}
+
+// send delivers data from src to dst after the link's delay, unless the
+// datagram is lost, the hosts are partitioned or nothing listens at dst.
+func (n *Network) send(src, dst Addr, data []byte) {
+	n.m.Lock()
+	r := n.link(src.Host, dst.Host)
+	lost := r.Float64() < n.config.Loss
+	delay := n.config.Latency
+	if n.config.Jitter > 0 {
+		delay += time.Duration(r.Int64N(int64(n.config.Jitter)))
+	}
+	if r.Float64() < n.config.Reorder {
+		delay += n.config.Latency + n.config.Jitter
+	}
+	if lost || !n.reachable(src.Host, dst.Host) {
+		n.m.Unlock()
+		return
+	}
+
+	d := datagram{from: src, data: append([]byte(nil), data...)}
+	if delay <= 0 {
+		n.m.Unlock()
+		n.deliver(dst, d)
+		return
+	}
+	n.sent++
+	heap.Push(&n.queue, delivery{at: time.Now().Add(delay), seq: n.sent, dst: dst, datagram: d})
+	if !n.dispatcher {
+		n.dispatcher = true
+		go n.dispatch()
+	}
+	n.m.Unlock()
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch delivers queued datagrams as they fall due, until the network is
+// closed.
+func (n *Network) dispatch() {
+	for {
+		n.m.Lock()
+		now := time.Now()
+		var due []delivery
+		for len(n.queue) > 0 && !n.queue[0].at.After(now) {
+			due = append(due, heap.Pop(&n.queue).(delivery))
+		}
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if len(n.queue) > 0 {
+			timer = time.NewTimer(n.queue[0].at.Sub(now))
+			timeout = timer.C
+		}
+		n.m.Unlock()
+
+		for _, d := range due {
+			n.deliver(d.dst, d.datagram)
+		}
+		select {
+		case <-n.wake:
+		case <-timeout:
+		case <-n.done:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-n.done:
+			return
+		default:
+		}
+	}
+}
+
+func (n *Network) deliver(dst Addr, d datagram) {
+	n.m.Lock()
+	c := n.sockets[dst.String()]
+	n.m.Unlock()
+	if c != nil {
+		c.push(d)
+	}
+}
+
+// delivery is a datagram waiting in the queue until its delivery time.
+type delivery struct {
+	at  time.Time
+	seq uint64
+	dst Addr
+	datagram
+}
+
+// deliveryQueue is a heap of deliveries ordered by time, then by the order
+// they were sent in.
+type deliveryQueue []delivery
+
+func (q deliveryQueue) Len() int {
+	return len(q)
+}
+
+func (q deliveryQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q deliveryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *deliveryQueue) Push(x any) {
+	*q = append(*q, x.(delivery))
+}
+
+func (q *deliveryQueue) Pop() any {
+	old := *q
+	d := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return d
+}
+
+type datagram struct {
+	from Addr
+	data []byte
+}
+
+// conn is a simulated socket. Dialed sockets have a remote address and
+// implement net.Conn; listening ones implement net.PacketConn. Received
+// datagrams are queued in a slice rather than a buffered channel so that
+// idle sockets stay small when thousands of servers share a process.
+type conn struct {
+	network *Network
+	local   Addr
+	remote  *Addr
+	closed  chan struct{}
+	once    sync.Once
+
+	m        sync.Mutex
+	inbox    []datagram
+	deadline time.Time
+	wake     chan struct{}
+}
+
+// push queues d, dropping it if the inbox is full.
+func (c *conn) push(d datagram) {
+	c.m.Lock()
+	if len(c.inbox) < inboxSize {
+		c.inbox = append(c.inbox, d)
+	}
+	c.m.Unlock()
+	c.signal()
+}
+
+// pop removes the oldest queued datagram, reporting false if there is none.
+func (c *conn) pop() (datagram, bool) {
+	if len(c.inbox) == 0 {
+		return datagram{}, false
+	}
+	d := c.inbox[0]
+	c.inbox = c.inbox[1:]
+	if len(c.inbox) == 0 {
+		c.inbox = nil
+	}
+	return d, true
+}
+
+// signal wakes a blocked ReadFrom.
+func (c *conn) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *conn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		default:
+		}
+
+		c.m.Lock()
+		d, ok := c.pop()
+		deadline := c.deadline
+		c.m.Unlock()
+		if ok {
+			if c.remote == nil || d.from == *c.remote {
+				return copy(p, d.data), d.from, nil
+			}
+			continue
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-c.wake:
+		case <-c.closed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (c *conn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	dst, ok := addr.(Addr)
+	if !ok {
+		return 0, errors.New("simnet: not a simulated address")
+	}
+	c.network.send(c.local, dst, p)
+	return len(p), nil
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if c.remote == nil {
+		return 0, errors.New("simnet: socket is not connected")
+	}
+	return c.WriteTo(p, *c.remote)
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.network.unlisten(c)
+	})
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return nil
+	}
+	return *c.remote
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.m.Lock()
+	c.deadline = t
+	c.m.Unlock()
+	c.signal()
+	return nil
+}
+
+// SetWriteDeadline has no effect: writes never block.
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
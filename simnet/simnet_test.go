@@ -0,0 +1,166 @@
+package simnet
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func listen(t *testing.T, n *Network, host string, port int) net.PacketConn {
+	conn, err := n.Host(host).ListenPacket(host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func dial(t *testing.T, n *Network, from, host string, port int) net.Conn {
+	conn, err := n.Host(from).DialPacket(host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// received sends count datagrams from a to b and reports which arrived.
+func received(t *testing.T, n *Network, count int) []bool {
+	server := listen(t, n, "b", 0)
+	client := dial(t, n, "a", "b", server.LocalAddr().(Addr).Port)
+	for i := 0; i < count; i++ {
+		if _, err := client.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := make([]bool, count)
+	buf := make([]byte, 16)
+	for {
+		server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, _, err := server.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return got
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[buf[0]] = true
+	}
+}
+
+func TestNetwork_RoundTrip(t *testing.T) {
+	n := New(1, Config{})
+	server := listen(t, n, "b", 1)
+	client := dial(t, n, "a", "b", 1)
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	size, from, err := server.ReadFrom(buf)
+	if err != nil || string(buf[:size]) != "ping" {
+		t.Fatalf("ReadFrom() = %q, %v", buf[:size], err)
+	}
+	if _, err := server.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	size, err = client.Read(buf)
+	if err != nil || string(buf[:size]) != "pong" {
+		t.Errorf("Read() = %q, %v", buf[:size], err)
+	}
+}
+
+func TestNetwork_ListenPicksFreePort(t *testing.T) {
+	n := New(1, Config{})
+	listen(t, n, "a", 1)
+	if _, err := n.Host("a").ListenPacket("a", 1); err == nil {
+		t.Errorf("Listening twice on the same address should fail")
+	}
+	first := listen(t, n, "a", 0)
+	second := listen(t, n, "a", 0)
+	if first.LocalAddr() == second.LocalAddr() {
+		t.Errorf("Sockets on port 0 should get different ports, both got %s", first.LocalAddr())
+	}
+}
+
+func TestNetwork_LossIsDeterministic(t *testing.T) {
+	config := Config{Loss: 0.5}
+	first := received(t, New(7, config), 100)
+	second := received(t, New(7, config), 100)
+
+	lost := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("The same seed should drop the same datagrams, datagram %d differs", i)
+		}
+		if !first[i] {
+			lost++
+		}
+	}
+	if lost == 0 || lost == len(first) {
+		t.Errorf("About half of the datagrams should be lost, %d of %d were", lost, len(first))
+	}
+}
+
+func TestNetwork_Partition(t *testing.T) {
+	n := New(1, Config{})
+	n.Partition([]string{"a"}, []string{"b"})
+	for i, ok := range received(t, n, 5) {
+		if ok {
+			t.Fatalf("Datagram %d crossed a partition", i)
+		}
+	}
+
+	n.Heal()
+	for i, ok := range received(t, n, 5) {
+		if !ok {
+			t.Fatalf("Datagram %d was lost after the partition healed", i)
+		}
+	}
+}
+
+func TestConn_ReadDeadline(t *testing.T) {
+	n := New(1, Config{})
+	server := listen(t, n, "a", 1)
+	server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := server.ReadFrom(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("ReadFrom() past the deadline = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestNetwork_DelaysFollowVirtualClock(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		n := New(1, Config{Latency: time.Hour, Reorder: 0.5})
+		t.Cleanup(func() { n.Close() })
+		server := listen(t, n, "b", 1)
+		client := dial(t, n, "a", "b", 1)
+
+		start := time.Now()
+		for i := 0; i < 10; i++ {
+			if _, err := client.Write([]byte{byte(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Datagrams held back by Reorder arrive an hour after the others, and
+		// datagrams due at the same time arrive in the order they were sent.
+		buf := make([]byte, 16)
+		var lastDelay time.Duration
+		last := -1
+		for i := 0; i < 10; i++ {
+			if _, _, err := server.ReadFrom(buf); err != nil {
+				t.Fatal(err)
+			}
+			delay := time.Since(start)
+			if delay != time.Hour && delay != 2*time.Hour {
+				t.Errorf("Datagram %d arrived after %s, want 1h or 2h", buf[0], delay)
+			}
+			if delay == lastDelay && int(buf[0]) < last {
+				t.Errorf("Datagram %d arrived after datagram %d", buf[0], last)
+			}
+			lastDelay, last = delay, int(buf[0])
+		}
+	})
+}